@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/server"
+	"github.com/alexellis/inlets/pkg/transport"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to a flag's name to give its environment variable,
+// i.e. INLETS_GATEWAY_TIMEOUT for --gateway-timeout
+const envPrefix = "INLETS_"
+
+// setting is a single value from the config file and the line it was on
+type setting struct {
+	value string
+	line  int
+	set   bool
+}
+
+func (s *setting) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: expected a single value", node.Line)
+	}
+
+	s.value = node.Value
+	s.line = node.Line
+	s.set = true
+	return nil
+}
+
+// config is read from the file given by --config, each setting replaces the
+// default of the flag it corresponds to
+type config struct {
+	Mode setting `yaml:"mode"`
+
+	Log struct {
+		Level  setting `yaml:"level"`
+		Format setting `yaml:"format"`
+	} `yaml:"log"`
+
+	Admin struct {
+		Port  setting `yaml:"port"`
+		Token setting `yaml:"token"`
+	} `yaml:"admin"`
+
+	PingInterval  setting `yaml:"ping_interval"`
+	PongTimeout   setting `yaml:"pong_timeout"`
+	DrainTimeout  setting `yaml:"drain_timeout"`
+	TraceEndpoint setting `yaml:"trace_endpoint"`
+
+	Server serverConfig `yaml:"server"`
+	Client clientConfig `yaml:"client"`
+}
+
+type serverConfig struct {
+	Port               setting `yaml:"port"`
+	GatewayTimeout     setting `yaml:"gateway_timeout"`
+	Token              setting `yaml:"token"`
+	TokenFile          setting `yaml:"token_file"`
+	TokenSecret        setting `yaml:"token_secret"`
+	PrintToken         setting `yaml:"print_token"`
+	MaxAuthFailures    setting `yaml:"max_auth_failures"`
+	AuthBanDuration    setting `yaml:"auth_ban_duration"`
+	AccessFile         setting `yaml:"access_file"`
+	AccessLog          setting `yaml:"access_log"`
+	UDPIdleTimeout     setting `yaml:"udp_idle_timeout"`
+	ClientWaitTimeout  setting `yaml:"client_wait_timeout"`
+	MaxWaitingRequests setting `yaml:"max_waiting_requests"`
+
+	TLS struct {
+		Port      setting `yaml:"port"`
+		Cert      setting `yaml:"cert"`
+		Key       setting `yaml:"key"`
+		ClientCA  setting `yaml:"client_ca"`
+		ClientCRL setting `yaml:"client_crl"`
+	} `yaml:"tls"`
+
+	ACME struct {
+		Enabled   setting `yaml:"enabled"`
+		Email     setting `yaml:"email"`
+		Directory setting `yaml:"directory"`
+		CAFile    setting `yaml:"ca_file"`
+		CacheDir  setting `yaml:"cache_dir"`
+		Domains   setting `yaml:"domains"`
+	} `yaml:"acme"`
+
+	OIDC struct {
+		Issuer       setting `yaml:"issuer"`
+		ClientID     setting `yaml:"client_id"`
+		ClientSecret setting `yaml:"client_secret"`
+		CookieSecret setting `yaml:"cookie_secret"`
+	} `yaml:"oidc"`
+
+	Hosts map[string]hostConfig `yaml:"hosts"`
+}
+
+// hostConfig overrides settings for one public host, see server.HostOptions
+type hostConfig struct {
+	GatewayTimeout  setting            `yaml:"gateway_timeout"`
+	RequestHeaders  map[string]setting `yaml:"request_headers"`
+	ResponseHeaders map[string]setting `yaml:"response_headers"`
+	BasicAuth       map[string]setting `yaml:"basic_auth"`
+	BearerTokens    []setting          `yaml:"bearer_tokens"`
+	AllowCIDRs      []setting          `yaml:"allow_cidrs"`
+
+	// OIDC requires a login when given, {} allows any email domain
+	OIDC *struct {
+		EmailDomains []setting `yaml:"email_domains"`
+	} `yaml:"oidc"`
+}
+
+type clientConfig struct {
+	Remote             setting `yaml:"remote"`
+	Token              setting `yaml:"token"`
+	CAFile             setting `yaml:"ca_file"`
+	Fingerprint        setting `yaml:"fingerprint"`
+	InsecureSkipVerify setting `yaml:"insecure_skip_verify"`
+	Concurrency        setting `yaml:"concurrency"`
+	MaxReconnectDelay  setting `yaml:"max_reconnect_delay"`
+
+	TLS struct {
+		Cert setting `yaml:"cert"`
+		Key  setting `yaml:"key"`
+	} `yaml:"tls"`
+
+	// Upstreams maps hostnames, tcp:<port> and udp:<port> to where they are
+	// proxied, "*" is the default upstream
+	Upstreams map[string]setting `yaml:"upstreams"`
+}
+
+// flagSetting ties a setting to the flag it replaces, key is its path in the
+// config file for errors
+type flagSetting struct {
+	flag    string
+	key     string
+	setting setting
+}
+
+// loadConfig reads a config file. Unknown keys, keys given twice, keys
+// without a value and values of the wrong kind are errors which give their
+// line.
+func loadConfig(file string) (*config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*config, error) {
+	c := &config{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		if err == io.EOF {
+			return c, nil
+		}
+		return nil, parseError(err)
+	}
+
+	// A key without a value decodes as if it were missing, which would
+	// silently drop a setting such as a host's oidc policy
+	root := yaml.Node{}
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, parseError(err)
+	}
+	if err := checkValues(&root); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// checkValues finds keys and list items which have no value
+func checkValues(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if value.ShortTag() == "!!null" {
+				return fmt.Errorf("line %d: no value given for %s", key.Line, key.Value)
+			}
+			if err := checkValues(value); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if item.ShortTag() == "!!null" {
+				return fmt.Errorf("line %d: no value given", item.Line)
+			}
+			if err := checkValues(item); err != nil {
+				return err
+			}
+		}
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if err := checkValues(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseError gives one line for each error found while decoding, naming
+// keys rather than the types they were decoded into
+func parseError(err error) error {
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return fmt.Errorf("%s", strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+
+	lines := make([]string, 0, len(typeErr.Errors))
+	for _, line := range typeErr.Errors {
+		if i := strings.Index(line, " not found in type "); i >= 0 {
+			line = strings.Replace(line[:i], "field ", "unknown key ", 1)
+		}
+		lines = append(lines, line)
+	}
+	return fmt.Errorf("%s", strings.Join(lines, "\n"))
+}
+
+// apply sets each flag given in the config which was not set on the
+// command-line or from the environment. Only the section for the mode
+// being run is used, so one file may hold both.
+func (c *config) apply(flags *flag.FlagSet, set map[string]bool) error {
+	if c.Mode.set && !set["server"] {
+		switch c.Mode.value {
+		case "server":
+			flags.Set("server", "true")
+		case "client":
+			flags.Set("server", "false")
+		default:
+			return fmt.Errorf("line %d: mode must be server or client, not %q", c.Mode.line, c.Mode.value)
+		}
+	}
+
+	settings := []flagSetting{
+		{"log-level", "log.level", c.Log.Level},
+		{"log-format", "log.format", c.Log.Format},
+		{"admin-port", "admin.port", c.Admin.Port},
+		{"admin-token", "admin.token", c.Admin.Token},
+		{"ping-interval", "ping_interval", c.PingInterval},
+		{"pong-timeout", "pong_timeout", c.PongTimeout},
+		{"drain-timeout", "drain_timeout", c.DrainTimeout},
+		{"trace-endpoint", "trace_endpoint", c.TraceEndpoint},
+	}
+
+	if serverMode(flags) {
+		s := c.Server
+		settings = append(settings, []flagSetting{
+			{"port", "server.port", s.Port},
+			{"gateway-timeout", "server.gateway_timeout", s.GatewayTimeout},
+			{"token", "server.token", s.Token},
+			{"token-file", "server.token_file", s.TokenFile},
+			{"token-secret", "server.token_secret", s.TokenSecret},
+			{"print-token", "server.print_token", s.PrintToken},
+			{"max-auth-failures", "server.max_auth_failures", s.MaxAuthFailures},
+			{"auth-ban-duration", "server.auth_ban_duration", s.AuthBanDuration},
+			{"access-file", "server.access_file", s.AccessFile},
+			{"access-log", "server.access_log", s.AccessLog},
+			{"udp-idle-timeout", "server.udp_idle_timeout", s.UDPIdleTimeout},
+			{"client-wait-timeout", "server.client_wait_timeout", s.ClientWaitTimeout},
+			{"max-waiting-requests", "server.max_waiting_requests", s.MaxWaitingRequests},
+			{"tls-port", "server.tls.port", s.TLS.Port},
+			{"tls-cert", "server.tls.cert", s.TLS.Cert},
+			{"tls-key", "server.tls.key", s.TLS.Key},
+			{"client-ca", "server.tls.client_ca", s.TLS.ClientCA},
+			{"client-crl", "server.tls.client_crl", s.TLS.ClientCRL},
+			{"acme", "server.acme.enabled", s.ACME.Enabled},
+			{"acme-email", "server.acme.email", s.ACME.Email},
+			{"acme-directory", "server.acme.directory", s.ACME.Directory},
+			{"acme-ca-file", "server.acme.ca_file", s.ACME.CAFile},
+			{"acme-cache-dir", "server.acme.cache_dir", s.ACME.CacheDir},
+			{"acme-domains", "server.acme.domains", s.ACME.Domains},
+			{"oidc-issuer", "server.oidc.issuer", s.OIDC.Issuer},
+			{"oidc-client-id", "server.oidc.client_id", s.OIDC.ClientID},
+			{"oidc-client-secret", "server.oidc.client_secret", s.OIDC.ClientSecret},
+			{"oidc-cookie-secret", "server.oidc.cookie_secret", s.OIDC.CookieSecret},
+		}...)
+	} else {
+		cl := c.Client
+		settings = append(settings, []flagSetting{
+			{"remote", "client.remote", cl.Remote},
+			{"token", "client.token", cl.Token},
+			{"ca-file", "client.ca_file", cl.CAFile},
+			{"fingerprint", "client.fingerprint", cl.Fingerprint},
+			{"insecure-skip-verify", "client.insecure_skip_verify", cl.InsecureSkipVerify},
+			{"concurrency", "client.concurrency", cl.Concurrency},
+			{"max-reconnect-delay", "client.max_reconnect_delay", cl.MaxReconnectDelay},
+			{"tls-cert", "client.tls.cert", cl.TLS.Cert},
+			{"tls-key", "client.tls.key", cl.TLS.Key},
+		}...)
+	}
+
+	for _, s := range settings {
+		if !s.setting.set || set[s.flag] {
+			continue
+		}
+		if err := flags.Set(s.flag, s.setting.value); err != nil {
+			return fmt.Errorf("line %d: invalid value %q for %s: %s", s.setting.line, s.setting.value, s.key, err)
+		}
+	}
+
+	return nil
+}
+
+// upstreams reads client.upstreams in the same form as --upstream gives
+func (c *config) upstreams() (map[string]string, error) {
+	upstreams := map[string]string{}
+
+	for key, s := range c.Client.Upstreams {
+		if err := validateUpstream(key, s.value); err != nil {
+			return nil, fmt.Errorf("line %d: invalid upstream for %s: %s", s.line, key, err)
+		}
+
+		if key == transport.DefaultUpstream {
+			key = ""
+		}
+		upstreams[key] = s.value
+	}
+	return upstreams, nil
+}
+
+func validateUpstream(key, value string) error {
+	if strings.HasPrefix(key, transport.TCPPrefix) || strings.HasPrefix(key, transport.UDPPrefix) {
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return fmt.Errorf("expected host:port, got %q", value)
+		}
+		return nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("expected an http:// or https:// URL, got %q", value)
+	}
+	return nil
+}
+
+// hosts reads server.hosts into options for the server
+func (c *config) hosts() (map[string]server.HostOptions, error) {
+	hosts := map[string]server.HostOptions{}
+
+	for host, h := range c.Server.Hosts {
+		for name, s := range h.RequestHeaders {
+			if !server.ValidHeaderName(name) {
+				return nil, fmt.Errorf("line %d: invalid request header name for %s: %q", s.line, host, name)
+			}
+		}
+		for name, s := range h.ResponseHeaders {
+			if !server.ValidHeaderName(name) {
+				return nil, fmt.Errorf("line %d: invalid response header name for %s: %q", s.line, host, name)
+			}
+		}
+		for user, s := range h.BasicAuth {
+			if _, err := bcrypt.Cost([]byte(s.value)); err != nil {
+				return nil, fmt.Errorf("line %d: invalid bcrypt hash for %s on %s: %s", s.line, user, host, err)
+			}
+		}
+
+		o := server.HostOptions{
+			RequestHeaders:  values(h.RequestHeaders),
+			ResponseHeaders: values(h.ResponseHeaders),
+			BasicAuth:       values(h.BasicAuth),
+		}
+
+		if h.GatewayTimeout.set {
+			timeout, err := time.ParseDuration(h.GatewayTimeout.value)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("line %d: invalid gateway_timeout for %s: %q", h.GatewayTimeout.line, host, h.GatewayTimeout.value)
+			}
+			o.GatewayTimeout = timeout
+		}
+
+		for _, s := range h.BearerTokens {
+			o.BearerTokens = append(o.BearerTokens, s.value)
+		}
+
+		for _, s := range h.AllowCIDRs {
+			if _, _, err := net.ParseCIDR(s.value); err != nil {
+				return nil, fmt.Errorf("line %d: invalid CIDR for %s: %q", s.line, host, s.value)
+			}
+			o.AllowCIDRs = append(o.AllowCIDRs, s.value)
+		}
+
+		if h.OIDC != nil {
+			o.OIDC = true
+			for _, s := range h.OIDC.EmailDomains {
+				o.OIDCEmailDomains = append(o.OIDCEmailDomains, s.value)
+			}
+		}
+
+		hosts[host] = o
+	}
+	return hosts, nil
+}
+
+func values(settings map[string]setting) map[string]string {
+	if len(settings) == 0 {
+		return nil
+	}
+
+	v := make(map[string]string, len(settings))
+	for key, s := range settings {
+		v[key] = s.value
+	}
+	return v
+}
+
+// applyEnv sets each flag which was not set on the command-line from its
+// INLETS_ environment variable, marking it as set
+func applyEnv(flags *flag.FlagSet, set map[string]bool) error {
+	var err error
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %s", value, name, setErr)
+			return
+		}
+		set[f.Name] = true
+	})
+
+	return err
+}
+
+// setFlags lists the flags given on the command-line
+func setFlags(flags *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+func serverMode(flags *flag.FlagSet) bool {
+	return flags.Lookup("server").Value.String() == "true"
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"unknown key", "server:\n  port: 80\n  prot: 81\n", "line 3: unknown key prot"},
+		{"key given twice", "server:\n  port: 80\n  port: 81\n", `line 3: mapping key "port" already defined at line 2`},
+		{"no value", "server:\n  port:\n", "line 2: no value given for port"},
+		{"oidc without a value", "server:\n  hosts:\n    app.example.com:\n      oidc:\n", "line 4: no value given for oidc"},
+		{"list item without a value", "server:\n  hosts:\n    app.example.com:\n      allow_cidrs:\n        -\n", "line 5: no value given"},
+		{"list for a single value", "server:\n  port: [80, 81]\n", "line 2: expected a single value"},
+		{"not YAML", "server: [\n", "line 1: did not find expected node content"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(test.config))
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("want error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestParseConfigEmpty(t *testing.T) {
+	for _, data := range []string{"", "# nothing set\n"} {
+		c, err := parseConfig([]byte(data))
+		if err != nil {
+			t.Fatalf("parse %q: %s", data, err)
+		}
+		if c.Mode.set || c.Server.Port.set {
+			t.Fatalf("want nothing set for %q", data)
+		}
+	}
+}
+
+// testFlags declares the flags used by the tests as main does
+func testFlags() (*flag.FlagSet, *Args) {
+	args := &Args{}
+	flags := flag.NewFlagSet("inlets", flag.ContinueOnError)
+	flags.BoolVar(&args.Server, "server", true, "")
+	flags.IntVar(&args.Port, "port", 8000, "")
+	flags.StringVar(&args.GatewayTimeoutRaw, "gateway-timeout", "5s", "")
+	flags.StringVar(&args.Token, "token", "", "")
+	flags.StringVar(&args.Remote, "remote", "127.0.0.1:8000", "")
+	flags.IntVar(&args.Concurrency, "concurrency", 10, "")
+	flags.DurationVar(&args.PingInterval, "ping-interval", 15*time.Second, "")
+	flags.StringVar(&args.LogLevel, "log-level", "info", "")
+	return flags, args
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"unknown mode", "mode: relay\n", `line 1: mode must be server or client, not "relay"`},
+		{"bad duration", "ping_interval: often\n", `line 1: invalid value "often" for ping_interval`},
+		{"bad number", "server:\n  port: http\n", `line 2: invalid value "http" for server.port`},
+		{"bad number in client mode", "mode: client\nclient:\n  concurrency: many\n", `line 3: invalid value "many" for client.concurrency`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := parseConfig([]byte(test.config))
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+
+			flags, _ := testFlags()
+			err = c.apply(flags, map[string]bool{})
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Fatalf("want error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestApplyPrecedence(t *testing.T) {
+	c, err := parseConfig([]byte(`
+mode: client
+log:
+  level: debug
+server:
+  port: 9000
+client:
+  remote: wss://file.example.com
+  token: from-file
+  concurrency: 4
+`))
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+
+	flags, args := testFlags()
+	if err := flags.Parse([]string{"--remote", "wss://flag.example.com"}); err != nil {
+		t.Fatalf("parse flags: %s", err)
+	}
+
+	t.Setenv("INLETS_REMOTE", "wss://env.example.com")
+	t.Setenv("INLETS_TOKEN", "from-env")
+
+	set := setFlags(flags)
+	if err := applyEnv(flags, set); err != nil {
+		t.Fatalf("apply env: %s", err)
+	}
+	if err := c.apply(flags, set); err != nil {
+		t.Fatalf("apply: %s", err)
+	}
+
+	if args.Server {
+		t.Errorf("want client mode from the file")
+	}
+	if args.Remote != "wss://flag.example.com" {
+		t.Errorf("want the remote from the command-line, got %s", args.Remote)
+	}
+	if args.Token != "from-env" {
+		t.Errorf("want the token from the environment, got %s", args.Token)
+	}
+	if args.Concurrency != 4 || args.LogLevel != "debug" {
+		t.Errorf("want concurrency and log level from the file, got %d and %s", args.Concurrency, args.LogLevel)
+	}
+	if args.Port != 8000 {
+		t.Errorf("want the server section ignored in client mode, got port %d", args.Port)
+	}
+}
+
+func TestApplyEnvError(t *testing.T) {
+	flags, _ := testFlags()
+	t.Setenv("INLETS_PING_INTERVAL", "often")
+
+	err := applyEnv(flags, map[string]bool{})
+	if err == nil || !strings.HasPrefix(err.Error(), `invalid value "often" for INLETS_PING_INTERVAL`) {
+		t.Fatalf("want an error naming the variable, got %v", err)
+	}
+}
+
+func TestConfigHosts(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"bad gateway timeout", "server:\n  hosts:\n    app.example.com:\n      gateway_timeout: soon\n", `line 4: invalid gateway_timeout for app.example.com: "soon"`},
+		{"negative gateway timeout", "server:\n  hosts:\n    app.example.com:\n      gateway_timeout: -1s\n", `line 4: invalid gateway_timeout for app.example.com: "-1s"`},
+		{"bad CIDR", "server:\n  hosts:\n    app.example.com:\n      allow_cidrs:\n        - 10.0.0.0/33\n", `line 5: invalid CIDR for app.example.com: "10.0.0.0/33"`},
+		{"bad request header name", "server:\n  hosts:\n    app.example.com:\n      request_headers:\n        X-Env: prod\n        \"X Team\": web\n", `line 6: invalid request header name for app.example.com: "X Team"`},
+		{"bad response header name", "server:\n  hosts:\n    app.example.com:\n      response_headers:\n        \"Cache:Control\": no-store\n", `line 5: invalid response header name for app.example.com: "Cache:Control"`},
+		{"bad bcrypt hash", "server:\n  hosts:\n    app.example.com:\n      basic_auth:\n        admin: plaintext\n", `line 5: invalid bcrypt hash for admin on app.example.com: crypto/bcrypt: hashedSecret too short to be a bcrypted password`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := parseConfig([]byte(test.config))
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+			if _, err := c.hosts(); err == nil || err.Error() != test.err {
+				t.Fatalf("want error %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	c, err := parseConfig([]byte(`
+server:
+  hosts:
+    app.example.com:
+      gateway_timeout: 30s
+      oidc: {}
+    api.example.com:
+      oidc:
+        email_domains: [example.com]
+      allow_cidrs: [10.0.0.0/8]
+`))
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+
+	hosts, err := c.hosts()
+	if err != nil {
+		t.Fatalf("hosts: %s", err)
+	}
+
+	app := hosts["app.example.com"]
+	if app.GatewayTimeout != 30*time.Second || !app.OIDC || len(app.OIDCEmailDomains) != 0 {
+		t.Fatalf("want a 30s timeout and a login for any domain, got %+v", app)
+	}
+	api := hosts["api.example.com"]
+	if !api.OIDC || len(api.OIDCEmailDomains) != 1 || len(api.AllowCIDRs) != 1 {
+		t.Fatalf("want a login for example.com from 10.0.0.0/8, got %+v", api)
+	}
+}
+
+func TestConfigUpstreams(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"no scheme", "client:\n  upstreams:\n    app.example.com: 127.0.0.1:3000\n", `line 3: invalid upstream for app.example.com: expected an http:// or https:// URL, got "127.0.0.1:3000"`},
+		{"port without host:port", "client:\n  upstreams:\n    tcp:2222: http://127.0.0.1:22\n", `line 3: invalid upstream for tcp:2222: expected host:port, got "http://127.0.0.1:22"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := parseConfig([]byte(test.config))
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+			if _, err := c.upstreams(); err == nil || err.Error() != test.err {
+				t.Fatalf("want error %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	c, err := parseConfig([]byte("client:\n  upstreams:\n    \"*\": http://127.0.0.1:3000\n    udp:5353: 127.0.0.1:53\n"))
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+
+	upstreams, err := c.upstreams()
+	if err != nil {
+		t.Fatalf("upstreams: %s", err)
+	}
+	if upstreams[""] != "http://127.0.0.1:3000" || upstreams["udp:5353"] != "127.0.0.1:53" {
+		t.Fatalf("want the default and UDP upstreams, got %v", upstreams)
+	}
+}
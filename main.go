@@ -1,59 +1,191 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/alexellis/inlets/pkg/client"
+	"github.com/alexellis/inlets/pkg/logger"
 	"github.com/alexellis/inlets/pkg/server"
 )
 
 // Args parsed from the command-line
 type Args struct {
-	Port              int
-	Server            bool
-	Remote            string
-	Upstream          string
-	GatewayTimeoutRaw string
-	GatewayTimeout    time.Duration
-	Token             string
-	PrintServerToken  bool
+	Port               int
+	Server             bool
+	Remote             string
+	Upstream           string
+	GatewayTimeoutRaw  string
+	GatewayTimeout     time.Duration
+	Token              string
+	PrintServerToken   bool
+	MaxReconnectDelay  time.Duration
+	Concurrency        int
+	UDPIdleTimeout     time.Duration
+	TokenFile          string
+	TokenSecret        string
+	MaxAuthFailures    int
+	AccessFile         string
+	AdminPort          int
+	AdminToken         string
+	OIDCIssuer         string
+	OIDCClientID       string
+	OIDCClientSecret   string
+	OIDCCookieSecret   string
+	AuthBanDuration    time.Duration
+	ClientCAFile       string
+	ClientCRLFile      string
+	CAFile             string
+	Fingerprint        string
+	InsecureSkipVerify bool
+	TLSPort            int
+	TLSCertFile        string
+	TLSKeyFile         string
+	ACME               bool
+	ACMEEmail          string
+	ACMEDirectory      string
+	ACMECAFile         string
+	ACMECacheDir       string
+	ACMEDomains        string
+	LogLevel           string
+	LogFormat          string
+	AccessLog          bool
+	TraceEndpoint      string
+	PingInterval       time.Duration
+	PongTimeout        time.Duration
+	ClientWaitTimeout  time.Duration
+	MaxWaitingRequests int
+	DrainTimeout       time.Duration
+	Config             string
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := tokenCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	args := Args{}
 	flag.IntVar(&args.Port, "port", 8000, "port for server")
 	flag.BoolVar(&args.Server, "server", true, "server or client")
-	flag.StringVar(&args.Remote, "remote", "127.0.0.1:8000", " server address i.e. 127.0.0.1:8000")
-	flag.StringVar(&args.Upstream, "upstream", "", "upstream server i.e. http://127.0.0.1:3000")
+	flag.StringVar(&args.Remote, "remote", "127.0.0.1:8000", " server address i.e. 127.0.0.1:8000 or wss://exit.example.com")
+	flag.StringVar(&args.Upstream, "upstream", "", "upstream server i.e. http://127.0.0.1:3000, tcp:2222=127.0.0.1:22 or udp:5353=127.0.0.1:53")
 	flag.StringVar(&args.GatewayTimeoutRaw, "gateway-timeout", "5s", "timeout for upstream gateway")
 	flag.StringVar(&args.Token, "token", "", "token for authentication")
+	flag.StringVar(&args.TokenFile, "token-file", "", "JSON file or directory of per-client tokens with scoped hostnames in server mode, reloaded on SIGHUP")
+	flag.StringVar(&args.TokenSecret, "token-secret", "", "secret to verify tokens from \"inlets token issue\" with in server mode")
+	flag.IntVar(&args.MaxAuthFailures, "max-auth-failures", 5, "failed authentication attempts after which a client IP is banned in server mode")
+	flag.DurationVar(&args.AuthBanDuration, "auth-ban-duration", 5*time.Minute, "how long to ban a client IP for after repeated authentication failures in server mode")
 	flag.BoolVar(&args.PrintServerToken, "print-token", true, "prints the token in server mode")
+	flag.IntVar(&args.TLSPort, "tls-port", 443, "port for HTTPS when TLS is enabled in server mode")
+	flag.StringVar(&args.TLSCertFile, "tls-cert", "", "TLS certificate file to serve HTTPS with in server mode, or to authenticate with in client mode")
+	flag.StringVar(&args.TLSKeyFile, "tls-key", "", "TLS private key file for --tls-cert")
+	flag.BoolVar(&args.ACME, "acme", false, "obtain TLS certificates for the hostnames registered by clients using ACME i.e. Let's Encrypt")
+	flag.StringVar(&args.ACMEEmail, "acme-email", "", "contact email for the ACME account")
+	flag.StringVar(&args.ACMEDirectory, "acme-directory", "", "ACME directory URL, defaults to Let's Encrypt production")
+	flag.StringVar(&args.ACMECAFile, "acme-ca-file", "", "CA certificate to verify a private ACME server such as Pebble")
+	flag.StringVar(&args.ACMECacheDir, "acme-cache-dir", "certs", "directory to cache ACME certificates in")
+	flag.StringVar(&args.ACMEDomains, "acme-domains", "", "comma-separated hostnames of the exit-node itself to obtain certificates for with --acme i.e. exit.example.com")
+	flag.StringVar(&args.ClientCAFile, "client-ca", "", "require tunnel clients to present a certificate signed by this CA in server mode")
+	flag.StringVar(&args.ClientCRLFile, "client-crl", "", "CRL of revoked client certificates for --client-ca")
+	flag.IntVar(&args.AdminPort, "admin-port", 0, "port to serve /metrics and the admin API on, kept apart from the tunnel, disabled when 0")
+	flag.StringVar(&args.AdminToken, "admin-token", "", "token for the admin API in server mode, the API is disabled when not set")
+	flag.StringVar(&args.AccessFile, "access-file", "", "JSON file of basic auth, bearer token and CIDR policies for public hosts in server mode")
+	flag.StringVar(&args.OIDCIssuer, "oidc-issuer", "", "OpenID Connect provider for hosts with an oidc access policy in server mode")
+	flag.StringVar(&args.OIDCClientID, "oidc-client-id", "", "client ID registered with the OpenID Connect provider")
+	flag.StringVar(&args.OIDCClientSecret, "oidc-client-secret", "", "client secret registered with the OpenID Connect provider")
+	flag.StringVar(&args.OIDCCookieSecret, "oidc-cookie-secret", "", "secret to sign login sessions with, sessions end on restart when not set")
+	flag.DurationVar(&args.ClientWaitTimeout, "client-wait-timeout", 0, "how long requests for a host with no connected client wait for one in server mode, they fail straight away when 0")
+	flag.IntVar(&args.MaxWaitingRequests, "max-waiting-requests", 100, "maximum number of requests waiting for a client at once in server mode")
+	flag.DurationVar(&args.UDPIdleTimeout, "udp-idle-timeout", time.Minute, "how long to keep UDP sessions without traffic in server mode")
+	flag.IntVar(&args.Concurrency, "concurrency", 10, "maximum number of requests to proxy to upstreams at once in client mode")
+	flag.StringVar(&args.CAFile, "ca-file", "", "CA certificate to verify a wss:// remote signed by a private CA in client mode")
+	flag.StringVar(&args.Fingerprint, "fingerprint", "", "SHA-256 fingerprint of the remote's certificate to pin in client mode")
+	flag.BoolVar(&args.InsecureSkipVerify, "insecure-skip-verify", false, "accept any certificate from a wss:// remote in client mode, for testing only")
+	flag.DurationVar(&args.MaxReconnectDelay, "max-reconnect-delay", time.Minute, "maximum delay between reconnection attempts in client mode")
+	flag.DurationVar(&args.PingInterval, "ping-interval", 15*time.Second, "how often to ping the other end of the tunnel, disabled when 0")
+	flag.DurationVar(&args.DrainTimeout, "drain-timeout", 30*time.Second, "how long requests in flight are given to finish on SIGTERM or SIGINT")
+	flag.DurationVar(&args.PongTimeout, "pong-timeout", 10*time.Second, "how long to wait for the other end of the tunnel after a missed ping before dropping the connection")
+	flag.StringVar(&args.LogLevel, "log-level", "info", "minimum level to log: debug, info, warn or error")
+	flag.StringVar(&args.LogFormat, "log-format", "text", "log format: text or json")
+	flag.BoolVar(&args.AccessLog, "access-log", true, "log each proxied request in server mode")
+	flag.StringVar(&args.TraceEndpoint, "trace-endpoint", "", "OTLP/HTTP collector to export trace spans to i.e. http://127.0.0.1:4318, disabled when not set")
+	flag.StringVar(&args.Config, "config", "", "YAML config file, overridden by INLETS_* environment variables and then by flags")
 
 	flag.Parse()
 
+	// Flags take precedence over the environment, then the config file
+	set := setFlags(flag.CommandLine)
+	if err := applyEnv(flag.CommandLine, set); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var fileConfig *config
+	if len(args.Config) > 0 {
+		c, err := loadConfig(args.Config)
+		if err == nil {
+			err = c.apply(flag.CommandLine, set)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", args.Config, err)
+			os.Exit(1)
+		}
+		fileConfig = c
+	}
+
+	if err := logger.Configure(args.LogLevel, args.LogFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	argsUpstreamParser := ArgsUpstreamParser{}
 
 	upstreamMap := map[string]string{}
 
 	if args.Server == false {
 
-		if len(args.Upstream) == 0 {
-			log.Printf("give --upstream\n")
+		if len(args.Upstream) > 0 {
+			upstreamMap = argsUpstreamParser.Parse(args.Upstream)
+		} else if fileConfig != nil {
+			fromFile, err := fileConfig.upstreams()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", args.Config, err)
+				os.Exit(1)
+			}
+			upstreamMap = fromFile
+		}
+
+		if len(upstreamMap) == 0 {
+			logger.Errorf("give --upstream")
 			return
 		}
-		upstreamMap = argsUpstreamParser.Parse(args.Upstream)
 		for key, val := range upstreamMap {
-			log.Printf("Upstream: %s => %s\n", key, val)
+			logger.Infof("Upstream: %s => %s", key, val)
+		}
+
+		if len(args.TLSCertFile) > 0 && len(args.TLSKeyFile) == 0 {
+			logger.Errorf("give --tls-key with --tls-cert")
+			return
+		}
+
+		if args.InsecureSkipVerify && len(args.Fingerprint) == 0 {
+			logger.Warnf("TLS certificate verification is disabled by --insecure-skip-verify")
 		}
 	}
 
 	if args.Server {
 
 		if len(args.Token) > 0 && args.PrintServerToken {
-			log.Printf("Server token: %s", args.Token)
+			logger.Infof("Server token: %s", args.Token)
 		}
 
 		gatewayTimeout, gatewayTimeoutErr := time.ParseDuration(args.GatewayTimeoutRaw)
@@ -63,27 +195,124 @@ func main() {
 		}
 
 		args.GatewayTimeout = gatewayTimeout
-		log.Printf("Gateway timeout: %f secs\n", gatewayTimeout.Seconds())
+		logger.Infof("Gateway timeout: %f secs", gatewayTimeout.Seconds())
+
+		if args.ACME && len(args.TLSCertFile) > 0 {
+			logger.Errorf("give either --tls-cert or --acme")
+			return
+		}
+
+		if len(args.TLSCertFile) > 0 && len(args.TLSKeyFile) == 0 {
+			logger.Errorf("give --tls-key with --tls-cert")
+			return
+		}
+
+		if len(args.ACMEDomains) > 0 && !args.ACME {
+			logger.Errorf("give --acme with --acme-domains")
+			return
+		}
+
+		if len(args.ClientCAFile) > 0 && len(args.TLSCertFile) == 0 && !args.ACME {
+			logger.Errorf("give --tls-cert or --acme with --client-ca")
+			return
+		}
+
+		if len(args.OIDCIssuer) > 0 && len(args.OIDCClientID) == 0 {
+			logger.Errorf("give --oidc-client-id with --oidc-issuer")
+			return
+		}
+
+		if len(args.ClientCRLFile) > 0 && len(args.ClientCAFile) == 0 {
+			logger.Errorf("give --client-ca with --client-crl")
+			return
+		}
+	}
+
+	hosts := map[string]server.HostOptions{}
+	if args.Server && fileConfig != nil {
+		fromFile, err := fileConfig.hosts()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", args.Config, err)
+			os.Exit(1)
+		}
+		hosts = fromFile
 	}
 
 	if args.Server {
 		server := server.Server{
-			Port:           args.Port,
-			GatewayTimeout: args.GatewayTimeout,
-			Token:          args.Token,
+			Port:               args.Port,
+			GatewayTimeout:     args.GatewayTimeout,
+			Token:              args.Token,
+			TokenFile:          args.TokenFile,
+			TokenSecret:        args.TokenSecret,
+			MaxAuthFailures:    args.MaxAuthFailures,
+			AuthBanDuration:    args.AuthBanDuration,
+			AccessFile:         args.AccessFile,
+			AdminPort:          args.AdminPort,
+			AdminToken:         args.AdminToken,
+			OIDCIssuer:         args.OIDCIssuer,
+			OIDCClientID:       args.OIDCClientID,
+			OIDCClientSecret:   args.OIDCClientSecret,
+			OIDCCookieSecret:   args.OIDCCookieSecret,
+			UDPIdleTimeout:     args.UDPIdleTimeout,
+			TLSPort:            args.TLSPort,
+			TLSCertFile:        args.TLSCertFile,
+			TLSKeyFile:         args.TLSKeyFile,
+			ACME:               args.ACME,
+			ACMEEmail:          args.ACMEEmail,
+			ACMEDirectory:      args.ACMEDirectory,
+			ACMECAFile:         args.ACMECAFile,
+			ACMECacheDir:       args.ACMECacheDir,
+			ACMEDomains:        splitList(args.ACMEDomains),
+			ClientCAFile:       args.ClientCAFile,
+			ClientCRLFile:      args.ClientCRLFile,
+			AccessLog:          args.AccessLog,
+			TraceEndpoint:      args.TraceEndpoint,
+			PingInterval:       args.PingInterval,
+			PongTimeout:        args.PongTimeout,
+			ClientWaitTimeout:  args.ClientWaitTimeout,
+			MaxWaitingRequests: args.MaxWaitingRequests,
+			DrainTimeout:       args.DrainTimeout,
+			Hosts:              hosts,
 		}
 		server.Serve()
 
 	} else {
 		client := client.Client{
-			Remote:      args.Remote,
-			UpstreamMap: upstreamMap,
-			Token:       args.Token,
+			Remote:             args.Remote,
+			UpstreamMap:        upstreamMap,
+			Token:              args.Token,
+			MaxReconnectDelay:  args.MaxReconnectDelay,
+			Concurrency:        args.Concurrency,
+			CAFile:             args.CAFile,
+			Fingerprint:        args.Fingerprint,
+			InsecureSkipVerify: args.InsecureSkipVerify,
+			CertFile:           args.TLSCertFile,
+			KeyFile:            args.TLSKeyFile,
+			AdminPort:          args.AdminPort,
+			TraceEndpoint:      args.TraceEndpoint,
+			PingInterval:       args.PingInterval,
+			PongTimeout:        args.PongTimeout,
+			DrainTimeout:       args.DrainTimeout,
 		}
 
-		err := client.Connect()
+		// The first signal drains requests in flight, another exits
+		ctx, cancel := context.WithCancel(context.Background())
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			sig := <-stop
+			logger.Infof("Received %s, shutting down", sig)
+			cancel()
 
-		if err != nil {
+			<-stop
+			logger.Warnf("Received a second signal, exiting without draining")
+			os.Exit(1)
+		}()
+
+		err := client.ConnectWithRetry(ctx)
+
+		if err != nil && err != context.Canceled {
 			panic(err)
 		}
 	}
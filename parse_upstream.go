@@ -15,6 +15,17 @@ func (a *ArgsUpstreamParser) Parse(input string) map[string]string {
 	return upstreamMap
 }
 
+// splitList reads a comma-separated flag, ignoring empty entries
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func buildUpstreamMap(args string) map[string]string {
 	items := make(map[string]string)
 
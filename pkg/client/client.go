@@ -2,151 +2,584 @@ package client
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
-	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/alexellis/inlets/pkg/logger"
+	"github.com/alexellis/inlets/pkg/tracing"
 	"github.com/alexellis/inlets/pkg/transport"
 	"github.com/gorilla/websocket"
 )
 
-var httpClient *http.Client
-
 // Client for inlets
 type Client struct {
-	// Remote site for websocket address
+	// Remote site for websocket address, either host:port or a ws:// or
+	// wss:// URL
 	Remote string
 
+	// CAFile verifies a wss:// remote signed by a private CA
+	CAFile string
+
+	// Fingerprint pins the remote's certificate by its SHA-256 hash
+	Fingerprint string
+
+	// InsecureSkipVerify accepts any certificate from a wss:// remote
+	InsecureSkipVerify bool
+
+	// CertFile and KeyFile hold a client certificate for exit-nodes which
+	// require mutual TLS
+	CertFile string
+	KeyFile  string
+
 	// Map of upstream servers dns.entry=http://ip:port
 	UpstreamMap map[string]string
 
 	// Token for authentication
 	Token string
+
+	// MaxReconnectDelay caps the exponential backoff between reconnection
+	// attempts made by ConnectWithRetry
+	MaxReconnectDelay time.Duration
+
+	// PingInterval is how often the server is pinged, and PongTimeout how
+	// long to wait after that before reconnecting to a silent server
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// DrainTimeout is how long requests in flight are given to finish
+	// once the context passed to ConnectWithRetry is cancelled
+	DrainTimeout time.Duration
+
+	// Concurrency limits how many requests are proxied to upstreams at once
+	Concurrency int
+
+	// AdminPort serves metrics when set
+	AdminPort int
+
+	// TraceEndpoint is an OTLP/HTTP collector to export spans to
+	TraceEndpoint string
+
+	tracerOnce sync.Once
+	tracer     *tracing.Tracer
+
+	upstreamClientOnce sync.Once
+	upstreamClient     *http.Client
+}
+
+// defaultConcurrency is used when Concurrency is not set
+const defaultConcurrency = 10
+
+// getTracer returns nil, which records nothing, without a TraceEndpoint
+func (c *Client) getTracer() *tracing.Tracer {
+	c.tracerOnce.Do(func() {
+		if len(c.TraceEndpoint) > 0 {
+			c.tracer = tracing.NewTracer(c.TraceEndpoint, "inlets-client")
+			logger.Infof("Exporting traces to %s", c.TraceEndpoint)
+		}
+	})
+	return c.tracer
+}
+
+// getUpstreamClient returns the client shared by requests to the upstreams.
+// Redirects are passed back to the caller rather than followed. There is
+// no overall timeout, which would cut off long downloads and event
+// streams, instead each request is cancelled when its stream is reset,
+// such as by the exit-node's gateway timeout.
+func (c *Client) getUpstreamClient() *http.Client {
+	c.upstreamClientOnce.Do(func() {
+		c.upstreamClient = &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   10 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: time.Second,
+			},
+		}
+	})
+	return c.upstreamClient
 }
 
 // Connect connect and serve traffic through websocket
 func (c *Client) Connect() error {
+	_, err := c.connect(context.Background())
+	return err
+}
+
+// connect serves traffic until the websocket fails or ctx is cancelled,
+// connected reports whether the websocket was established.
+func (c *Client) connect(ctx context.Context) (connected bool, err error) {
+	u, err := c.remoteURL()
+	if err != nil {
+		return false, err
+	}
 
-	httpClient = http.DefaultClient
-	httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
+	dialer, err := c.dialer()
+	if err != nil {
+		return false, err
 	}
 
-	u := url.URL{Scheme: "ws", Host: c.Remote, Path: "/tunnel"}
-	log.Printf("connecting to %s", u.String())
+	logger.Infof("connecting to %s", u.String())
 
-	ws, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{
-		"Authorization": []string{"Bearer " + c.Token},
+	ws, res, err := dialer.DialContext(ctx, u.String(), http.Header{
+		"Authorization":          []string{"Bearer " + c.Token},
+		transport.UpstreamHeader: []string{c.upstreamHosts()},
 	})
 
 	if err != nil {
-		return err
+		// The server explains why it rejected the client in the body
+		if res != nil {
+			body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+			return false, fmt.Errorf("%s: %s %s", err, res.Status, body)
+		}
+		return false, err
 	}
 
-	log.Printf("Connected to websocket: %s", ws.LocalAddr())
+	logger.Infof("Connected to websocket: %s", ws.LocalAddr())
+
+	tunnelConnected.Set(1)
+	defer tunnelConnected.Set(0)
+
+	session := transport.NewSession(ws)
+	session.Heartbeat(c.PingInterval, c.PongTimeout)
+	defer session.Close()
+
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	// active counts the streams being proxied so that they can be drained
+	var active int64
+	track := func(proxy func(*transport.Stream), stream *transport.Stream) {
+		defer atomic.AddInt64(&active, -1)
+		proxy(stream)
+	}
+
+	// Streams are accepted by a bounded pool of workers so that a slow
+	// upstream does not hold up every other request in the tunnel.
+	workers := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				stream, err := session.Accept()
+				if err != nil {
+					return
+				}
+				atomic.AddInt64(&active, 1)
+
+				// Forwarded TCP connections and UDP sessions are
+				// long-lived so they are not counted against the pool of
+				// HTTP workers.
+				if strings.HasPrefix(stream.Target(), transport.TCPPrefix) {
+					go track(c.proxyTCP, stream)
+					continue
+				}
+				if strings.HasPrefix(stream.Target(), transport.UDPPrefix) {
+					go track(c.proxyUDP, stream)
+					continue
+				}
 
-	defer ws.Close()
+				// An upgraded connection, such as a WebSocket, is relayed
+				// outside the pool once its response has been written
+				if relay := c.proxyToUpstream(stream); relay != nil {
+					go func() {
+						defer atomic.AddInt64(&active, -1)
+						relay()
+					}()
+					continue
+				}
+				atomic.AddInt64(&active, -1)
+			}
+		}()
+	}
+	defer workers.Wait()
 
 	done := make(chan struct{})
+	var readErr error
 
 	go func() {
 		defer close(done)
-		for {
-			messageType, message, err := ws.ReadMessage()
-			if err != nil {
-				log.Println("read:", err)
-				return
-			}
+		readErr = session.Serve()
+		if websocket.IsCloseError(readErr, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+			logger.Infof("exit-node shut down cleanly")
+		} else if readErr != transport.ErrSessionClosed {
+			logger.Errorf("read: %s", readErr)
+		}
+	}()
 
-			switch messageType {
-			case websocket.TextMessage:
-				log.Printf("TextMessage: %s\n", message)
+	select {
+	case <-done:
+		return true, readErr
+	case <-ctx.Done():
+		c.drain(session, &active)
+		session.Close()
+		<-done
+		return true, ctx.Err()
+	}
+}
 
-				break
-			case websocket.BinaryMessage:
-				// proxyToUpstream
+// drain asks the server to stop routing requests to this client, then waits
+// up to DrainTimeout for those already being proxied to finish
+func (c *Client) drain(session *transport.Session, active *int64) {
+	if c.DrainTimeout <= 0 {
+		return
+	}
 
-				buf := bytes.NewBuffer(message)
-				bufReader := bufio.NewReader(buf)
-				req, readReqErr := http.ReadRequest(bufReader)
-				if readReqErr != nil {
-					log.Println(readReqErr)
-					return
-				}
+	if err := session.GoAway(); err != nil {
+		return
+	}
 
-				inletsID := req.Header.Get(transport.InletsHeader)
-				// log.Printf("[%s] recv: %d", requestID, len(message))
+	logger.Infof("Draining %d requests for up to %s", atomic.LoadInt64(active), c.DrainTimeout)
 
-				log.Printf("[%s] %s", inletsID, req.RequestURI)
+	deadline := time.Now().Add(c.DrainTimeout)
 
-				body, _ := ioutil.ReadAll(req.Body)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
 
-				proxyHost := ""
-				if val, ok := c.UpstreamMap[req.Host]; ok {
-					proxyHost = val
-				} else if val, ok := c.UpstreamMap[""]; ok {
-					proxyHost = val
-				}
+	for atomic.LoadInt64(active) > 0 {
+		if time.Now().After(deadline) {
+			logger.Warnf("%d requests were still in flight after %s", atomic.LoadInt64(active), c.DrainTimeout)
+			return
+		}
 
-				requestURI := fmt.Sprintf("%s%s", proxyHost, req.URL.String())
-				if len(req.URL.RawQuery) > 0 {
-					requestURI = requestURI + "?" + req.URL.RawQuery
-				}
+		select {
+		case <-ticker.C:
+		case <-session.Done():
+			return
+		}
+	}
+}
+
+// proxyToUpstream reads a request from the stream, sends it to the
+// upstream and streams the response back. When the upstream switches
+// protocols the relay for the upgraded connection is returned for the caller
+// to run, it owns the stream and the upstream connection from then on.
+func (c *Client) proxyToUpstream(stream *transport.Stream) (relay func()) {
+	// The stream is only reset when the exchange was cut short. Once the
+	// request has been read and the response written it is left for the
+	// server's close, which may still be on its way.
+	complete := false
+	defer func() {
+		if !complete && relay == nil {
+			stream.Reset()
+		}
+	}()
 
-				log.Printf("[%s] proxy => %s", inletsID, requestURI)
+	br := bufio.NewReader(stream)
+	req, readReqErr := http.ReadRequest(br)
+	if readReqErr != nil {
+		logger.Errorf("%s", readReqErr)
+		return nil
+	}
 
-				newReq, newReqErr := http.NewRequest(req.Method, requestURI, bytes.NewReader(body))
-				if newReqErr != nil {
-					log.Printf("[%s] newReqErr: %s", inletsID, newReqErr.Error())
-					return
-				}
+	body := &eofReader{ReadCloser: req.Body}
+	if req.Body != http.NoBody {
+		req.Body = body
+	}
+
+	inletsID := stream.ID()
+
+	logger.ID(inletsID).Debugf("%s", req.RequestURI)
+
+	proxyHost := c.upstream(req.Host)
+
+	requestURI := fmt.Sprintf("%s%s", proxyHost, req.URL.RequestURI())
+
+	logger.ID(inletsID).Debugf("proxy => %s", requestURI)
+
+	// Stop waiting on the upstream once the exit-node has given up on the
+	// request or the tunnel has dropped, so the worker is freed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		if relay == nil {
+			cancel()
+		}
+	}()
+	go func() {
+		select {
+		case <-stream.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	newReq, newReqErr := http.NewRequestWithContext(ctx, req.Method, requestURI, req.Body)
+	if newReqErr != nil {
+		logger.ID(inletsID).Errorf("newReqErr: %s", newReqErr.Error())
+		return nil
+	}
+	newReq.ContentLength = req.ContentLength
+
+	transport.CopyHeaders(newReq.Header, &req.Header)
+
+	// The exit-node's span is the parent and the upstream's spans are
+	// children of this one
+	span := c.getTracer().Start("upstream "+req.Method, tracing.KindClient, tracing.Extract(req.Header))
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("url.full", requestURI)
+	span.SetAttribute("inlets.id", inletsID)
+	span.Inject(newReq.Header)
+
+	start := time.Now()
+	res, resErr := c.getUpstreamClient().Do(newReq)
+	duration := time.Since(start)
+	requestDuration.Observe(duration.Seconds(), proxyHost)
+
+	if resErr != nil {
+		span.SetError(resErr.Error())
+	} else {
+		span.SetAttribute("http.response.status_code", res.StatusCode)
+		if res.StatusCode >= http.StatusInternalServerError {
+			span.SetError(res.Status)
+		}
+	}
+	span.End()
+
+	if resErr != nil && ctx.Err() != nil {
+		logger.ID(inletsID).Warnf("gave up on %s after %s, the request was cancelled through the tunnel", requestURI, duration)
+		return nil
+	}
+
+	if resErr != nil {
+		logger.ID(inletsID).Errorf("Upstream tunnel err: %s", resErr.Error())
+		upstreamErrors.Inc(proxyHost)
+
+		res = &http.Response{
+			StatusCode: http.StatusBadGateway,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(resErr.Error())),
+		}
+	}
+
+	logger.ID(inletsID).
+		With("upstream", proxyHost).
+		With("method", req.Method).
+		With("path", req.URL.Path).
+		With("status", res.StatusCode).
+		With("duration", duration).
+		Infof("upstream")
+
+	defer func() {
+		if relay == nil {
+			res.Body.Close()
+		}
+	}()
+
+	res.Header.Set(transport.InletsHeader, inletsID)
+	requestsTotal.Inc(proxyHost, strconv.Itoa(res.StatusCode))
+
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		pipe := c.proxyUpgrade(inletsID, res, transport.ReadWriteCloser{Reader: br, Writer: stream, Closer: stream})
+		if pipe == nil {
+			return nil
+		}
+		return func() {
+			defer stream.Reset()
+			defer cancel()
+			defer res.Body.Close()
+			pipe()
+		}
+	}
+
+	if err := transport.WriteResponse(stream, res); err != nil {
+		logger.ID(inletsID).Errorf("unable to write response: %s", err)
+		return nil
+	}
+
+	stream.Close()
+	complete = req.Body == http.NoBody || body.done()
+	return nil
+}
+
+// eofReader records whether a request body was read to the end, the
+// upstream may reply before reading all of it
+type eofReader struct {
+	io.ReadCloser
+	eof int32
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		atomic.StoreInt32(&r.eof, 1)
+	}
+	return n, err
+}
+
+func (r *eofReader) done() bool {
+	return atomic.LoadInt32(&r.eof) == 1
+}
+
+// proxyTCP connects a stream for a forwarded TCP port to its upstream
+func (c *Client) proxyTCP(stream *transport.Stream) {
+	defer stream.Reset()
+
+	inletsID := stream.ID()
+
+	addr, ok := c.UpstreamMap[stream.Target()]
+	if !ok {
+		logger.ID(inletsID).Warnf("no upstream for %s", stream.Target())
+		return
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		logger.ID(inletsID).Errorf("Upstream tunnel err: %s", err.Error())
+		return
+	}
 
-				transport.CopyHeaders(newReq.Header, &req.Header)
+	logger.ID(inletsID).Debugf("%s => %s", stream.Target(), addr)
 
-				res, resErr := httpClient.Do(newReq)
+	transport.Pipe(conn, stream)
 
-				if resErr != nil {
-					log.Printf("[%s] Upstream tunnel err: %s", inletsID, resErr.Error())
+	logger.ID(inletsID).Debugf("connection to %s closed", addr)
+}
 
-					errRes := http.Response{
-						StatusCode: http.StatusBadGateway,
-						Body:       ioutil.NopCloser(strings.NewReader(resErr.Error())),
-					}
-					errRes.Header.Set(transport.InletsHeader, inletsID)
-					buf2 := new(bytes.Buffer)
-					errRes.Write(buf2)
-					if errRes.Body != nil {
-						defer errRes.Body.Close()
-					}
+// proxyUDP relays the datagrams of a UDP session to its upstream and
+// sends the replies back through the stream
+func (c *Client) proxyUDP(stream *transport.Stream) {
+	defer stream.Reset()
 
-					ws.WriteMessage(websocket.BinaryMessage, buf2.Bytes())
+	inletsID := stream.ID()
 
-				} else {
-					log.Printf("[%s] tunnel res.Status => %s", inletsID, res.Status)
+	addr, ok := c.UpstreamMap[stream.Target()]
+	if !ok {
+		logger.ID(inletsID).Warnf("no upstream for %s", stream.Target())
+		return
+	}
 
-					buf2 := new(bytes.Buffer)
-					res.Header.Set(transport.InletsHeader, inletsID)
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		logger.ID(inletsID).Errorf("Upstream tunnel err: %s", err.Error())
+		return
+	}
+	defer conn.Close()
 
-					res.Write(buf2)
-					if res.Body != nil {
-						defer res.Body.Close()
-					}
+	logger.ID(inletsID).Debugf("%s => %s", stream.Target(), addr)
 
-					log.Printf("[%s] %d bytes", inletsID, buf2.Len())
+	closed := make(chan struct{})
+	defer close(closed)
 
-					ws.WriteMessage(websocket.BinaryMessage, buf2.Bytes())
+	go func() {
+		buf := make([]byte, transport.MaxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				select {
+				case <-closed:
+					return
+				default:
 				}
-				break
+
+				// i.e. the upstream is not listening yet, which is only
+				// reported after a datagram has been sent to it
+				if errors.Is(err, syscall.ECONNREFUSED) {
+					continue
+				}
+
+				// Any other error ends the session rather than being read
+				// again and again
+				logger.ID(inletsID).Errorf("unable to read datagram from %s: %s", addr, err)
+				stream.Reset()
+				return
 			}
 
+			if err := transport.WriteDatagram(stream, buf[:n]); err != nil {
+				conn.Close()
+				return
+			}
 		}
 	}()
 
-	<-done
+	br := bufio.NewReader(stream)
+	for {
+		payload, err := transport.ReadDatagram(br)
+		if err != nil {
+			break
+		}
 
-	return nil
+		if _, err := conn.Write(payload); err != nil {
+			logger.ID(inletsID).Errorf("unable to relay datagram to %s: %s", addr, err)
+		}
+	}
+
+	logger.ID(inletsID).Debugf("session with %s closed", addr)
+}
+
+// proxyUpgrade relays a connection which the upstream has switched to
+// another protocol, such as a WebSocket. The response is written before it
+// returns and the pipe it returns runs until either side closes the
+// connection.
+func (c *Client) proxyUpgrade(inletsID string, res *http.Response, tunnel io.ReadWriteCloser) func() {
+	upstream, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		logger.ID(inletsID).Warnf("upstream switched protocols without a writable body")
+		return nil
+	}
+
+	head := *res
+	head.Body = nil
+	head.ContentLength = 0
+
+	if err := transport.WriteResponse(tunnel, &head); err != nil {
+		logger.ID(inletsID).Errorf("unable to write response: %s", err)
+		return nil
+	}
+
+	logger.ID(inletsID).Debugf("upgraded to %s", res.Header.Get("Upgrade"))
+
+	return func() {
+		transport.Pipe(upstream, tunnel)
+		logger.ID(inletsID).Debugf("upgraded connection closed")
+	}
+}
+
+// upstream finds the upstream URL for host, ignoring any port and falling
+// back to the default upstream
+func (c *Client) upstream(host string) string {
+	if val, ok := c.UpstreamMap[host]; ok {
+		return val
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		if val, ok := c.UpstreamMap[h]; ok {
+			return val
+		}
+	}
+	return c.UpstreamMap[""]
+}
+
+// upstreamHosts lists the hostnames served by this client for the server
+// to route to it
+func (c *Client) upstreamHosts() string {
+	hosts := []string{}
+	for host := range c.UpstreamMap {
+		if len(host) == 0 {
+			host = transport.DefaultUpstream
+		}
+		hosts = append(hosts, host)
+	}
+	return strings.Join(hosts, ",")
 }
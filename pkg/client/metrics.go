@@ -0,0 +1,40 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/alexellis/inlets/pkg/logger"
+	"github.com/alexellis/inlets/pkg/metrics"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	requestsTotal = registry.NewCounter("inlets_client_requests_total",
+		"HTTP requests proxied to upstreams.", "upstream", "status")
+
+	requestDuration = registry.NewHistogram("inlets_client_request_duration_seconds",
+		"Time taken for upstreams to respond.", metrics.DefaultBuckets, "upstream")
+
+	upstreamErrors = registry.NewCounter("inlets_client_upstream_errors_total",
+		"Requests which failed because the upstream could not be reached.", "upstream")
+
+	tunnelConnected = registry.NewGauge("inlets_client_connected",
+		"Whether the client is connected to the exit-node.")
+
+	reconnects = registry.NewCounter("inlets_client_reconnects_total",
+		"Reconnection attempts made after the connection failed or dropped.")
+)
+
+// serveAdmin serves metrics on AdminPort
+func (c *Client) serveAdmin() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+
+	logger.Infof("Serving admin on port %d", c.AdminPort)
+
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", c.AdminPort), mux); err != nil {
+		logger.Fatalf("%s", err)
+	}
+}
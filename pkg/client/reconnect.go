@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// initialReconnectDelay is the delay before the first reconnection attempt
+	initialReconnectDelay = time.Second
+
+	// defaultMaxReconnectDelay is used when MaxReconnectDelay is not set
+	defaultMaxReconnectDelay = time.Minute
+)
+
+// ConnectWithRetry connects and serves traffic through the websocket,
+// reconnecting with exponential backoff and jitter whenever the connection
+// fails or drops. It only returns once ctx is cancelled or when the remote
+// or TLS options are invalid, as retrying would not help.
+func (c *Client) ConnectWithRetry(ctx context.Context) error {
+	if _, err := c.remoteURL(); err != nil {
+		return err
+	}
+	if _, err := c.dialer(); err != nil {
+		return err
+	}
+
+	if c.AdminPort > 0 {
+		go c.serveAdmin()
+	}
+
+	defer c.flushTraces()
+
+	attempt := 0
+
+	for {
+		connected, err := c.connect(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// A connection which was established resets the backoff
+		if connected {
+			attempt = 0
+		}
+
+		delay := c.reconnectDelay(attempt)
+		attempt++
+
+		if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+			logger.Infof("Connection to %s closed by the exit-node, reconnecting in %s (attempt %d)", c.Remote, delay.Round(time.Millisecond), attempt)
+		} else {
+			logger.Warnf("Connection to %s lost: %v, reconnecting in %s (attempt %d)", c.Remote, err, delay.Round(time.Millisecond), attempt)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		reconnects.Inc()
+	}
+}
+
+// flushTraces exports the spans of the requests which were drained
+func (c *Client) flushTraces() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.getTracer().Flush(ctx); err != nil {
+		logger.Warnf("unable to export the remaining spans: %s", err)
+	}
+}
+
+// reconnectDelay doubles the delay for each failed attempt up to
+// MaxReconnectDelay, then picks a random delay between half and all of
+// it so that clients of a restarted server do not reconnect in lockstep.
+func (c *Client) reconnectDelay(attempt int) time.Duration {
+	maxDelay := c.MaxReconnectDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxReconnectDelay
+	}
+
+	delay := initialReconnectDelay
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
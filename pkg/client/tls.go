@@ -0,0 +1,107 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// remoteURL builds the websocket address from Remote, which is either a
+// host:port for a plain ws:// connection or a ws:// or wss:// URL
+func (c *Client) remoteURL() (*url.URL, error) {
+	if !strings.Contains(c.Remote, "://") {
+		return &url.URL{Scheme: "ws", Host: c.Remote, Path: "/tunnel"}, nil
+	}
+
+	u, err := url.Parse(c.Remote)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote: %s", err)
+	}
+
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("invalid remote: scheme must be ws or wss, not %s", u.Scheme)
+	}
+
+	if len(u.Path) == 0 || u.Path == "/" {
+		u.Path = "/tunnel"
+	}
+	return u, nil
+}
+
+// dialer returns a websocket dialer which verifies the exit-node's
+// certificate according to CAFile, Fingerprint and InsecureSkipVerify and
+// presents CertFile when it is set
+func (c *Client) dialer() (*websocket.Dialer, error) {
+	tlsConfig := &tls.Config{}
+
+	if len(c.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file: %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(c.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(c.Fingerprint) > 0 {
+		pinned, err := parseFingerprint(c.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		// A pinned certificate is trusted on its own, so a self-signed
+		// certificate can be used without a CA.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("no certificate presented by the remote")
+			}
+
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], pinned) {
+				return fmt.Errorf("certificate fingerprint %s does not match the pinned fingerprint", hex.EncodeToString(sum[:]))
+			}
+			return nil
+		}
+	} else if c.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		TLSClientConfig:  tlsConfig,
+	}, nil
+}
+
+// parseFingerprint decodes a SHA-256 fingerprint given as hex, optionally
+// separated by colons as printed by openssl
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	sum, err := hex.DecodeString(strings.Replace(fingerprint, ":", "", -1))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid fingerprint, expected a SHA-256 hash in hex: %s", fingerprint)
+	}
+	return sum, nil
+}
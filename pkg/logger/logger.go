@@ -0,0 +1,252 @@
+// Package logger writes leveled log lines as text or JSON. Lines about a
+// request carry its x-inlets-id so that it can be followed from the
+// exit-node to the client.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level orders log lines by importance
+type Level int
+
+// Levels from the most to the least verbose
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	}
+	return "info"
+}
+
+// ParseLevel reads a level given as debug, info, warn or error
+func ParseLevel(level string) (Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level: %s", level)
+}
+
+var (
+	lock   sync.Mutex
+	out    io.Writer = os.Stderr
+	level            = InfoLevel
+	asJSON           = false
+)
+
+// Configure sets the minimum level written and the format, which is
+// "text" or "json". Lines written with the standard log package are
+// formatted in the same way at the info level.
+func Configure(minLevel, format string) error {
+	parsed, err := ParseLevel(minLevel)
+	if err != nil {
+		return err
+	}
+
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	lock.Lock()
+	level = parsed
+	asJSON = format == "json"
+	lock.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+	return nil
+}
+
+// Field is a key and value added to a line
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Entry holds fields for the lines written through it
+type Entry struct {
+	fields []Field
+}
+
+// With returns an entry which adds key and value to every line
+func With(key string, value interface{}) *Entry {
+	return (&Entry{}).With(key, value)
+}
+
+// ID returns an entry for lines about the request or connection id
+func ID(id string) *Entry {
+	return With("id", id)
+}
+
+// With returns a copy of e which adds key and value to every line
+func (e *Entry) With(key string, value interface{}) *Entry {
+	fields := make([]Field, len(e.fields), len(e.fields)+1)
+	copy(fields, e.fields)
+
+	return &Entry{fields: append(fields, Field{Key: key, Value: value})}
+}
+
+// Debugf writes a debug line
+func (e *Entry) Debugf(format string, args ...interface{}) {
+	e.write(DebugLevel, fmt.Sprintf(format, args...))
+}
+
+// Infof writes an info line
+func (e *Entry) Infof(format string, args ...interface{}) {
+	e.write(InfoLevel, fmt.Sprintf(format, args...))
+}
+
+// Warnf writes a warning
+func (e *Entry) Warnf(format string, args ...interface{}) {
+	e.write(WarnLevel, fmt.Sprintf(format, args...))
+}
+
+// Errorf writes an error
+func (e *Entry) Errorf(format string, args ...interface{}) {
+	e.write(ErrorLevel, fmt.Sprintf(format, args...))
+}
+
+// Debugf writes a debug line
+func Debugf(format string, args ...interface{}) {
+	(&Entry{}).write(DebugLevel, fmt.Sprintf(format, args...))
+}
+
+// Infof writes an info line
+func Infof(format string, args ...interface{}) {
+	(&Entry{}).write(InfoLevel, fmt.Sprintf(format, args...))
+}
+
+// Warnf writes a warning
+func Warnf(format string, args ...interface{}) {
+	(&Entry{}).write(WarnLevel, fmt.Sprintf(format, args...))
+}
+
+// Errorf writes an error
+func Errorf(format string, args ...interface{}) {
+	(&Entry{}).write(ErrorLevel, fmt.Sprintf(format, args...))
+}
+
+// Fatalf writes an error and exits
+func Fatalf(format string, args ...interface{}) {
+	Errorf(format, args...)
+	os.Exit(1)
+}
+
+// Enabled reports whether lines at l are written
+func Enabled(l Level) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return l >= level
+}
+
+func (e *Entry) write(l Level, msg string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if l < level {
+		return
+	}
+
+	now := time.Now()
+	msg = strings.TrimSuffix(msg, "\n")
+
+	buf := &bytes.Buffer{}
+	if asJSON {
+		writeJSON(buf, now, l, msg, e.fields)
+	} else {
+		writeText(buf, now, l, msg, e.fields)
+	}
+	out.Write(buf.Bytes())
+}
+
+// writeText keeps the format of the standard log package, with the id in
+// square brackets before the message as it has always been logged
+func writeText(buf *bytes.Buffer, now time.Time, l Level, msg string, fields []Field) {
+	buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+	if l != InfoLevel {
+		buf.WriteString(strings.ToUpper(l.String()) + " ")
+	}
+
+	for _, f := range fields {
+		if f.Key == "id" {
+			fmt.Fprintf(buf, "[%v] ", f.Value)
+		}
+	}
+
+	buf.WriteString(msg)
+
+	for _, f := range fields {
+		if f.Key != "id" {
+			fmt.Fprintf(buf, " %s=%v", f.Key, f.Value)
+		}
+	}
+	buf.WriteString("\n")
+}
+
+func writeJSON(buf *bytes.Buffer, now time.Time, l Level, msg string, fields []Field) {
+	buf.WriteString(`{"time":`)
+	writeValue(buf, now.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeValue(buf, l.String())
+	buf.WriteString(`,"msg":`)
+	writeValue(buf, msg)
+
+	for _, f := range fields {
+		buf.WriteString(",")
+		writeValue(buf, f.Key)
+		buf.WriteString(":")
+		writeValue(buf, f.Value)
+	}
+	buf.WriteString("}\n")
+}
+
+func writeValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = v.Seconds()
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(data)
+}
+
+// stdWriter formats lines from the standard log package, which is still
+// used by dependencies and net/http
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	(&Entry{}).write(InfoLevel, string(p))
+	return len(p), nil
+}
@@ -0,0 +1,293 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets suit request latencies in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds the metrics of a process
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP writes every metric in the text exposition format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.lock.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, m := range metrics {
+		m.write(buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// vec holds one value per combination of label values
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+
+	// buckets and sum are only used by histograms
+	buckets []uint64
+	sum     float64
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*series),
+	}
+}
+
+// series finds the series for labelValues, the caller holds the lock
+func (v *vec) series(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, given %d values", v.name, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		v.values[key] = s
+	}
+	return s
+}
+
+// sorted returns the series ordered by their labels, the caller holds the
+// lock
+func (v *vec) sorted() []*series {
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sorted := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		sorted = append(sorted, v.values[key])
+	}
+	return sorted
+}
+
+func (v *vec) writeHeader(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+// write writes counters and gauges
+func (v *vec) write(buf *bytes.Buffer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.writeHeader(buf)
+
+	// A metric without labels is reported from the start
+	if len(v.labels) == 0 {
+		v.series(nil)
+	}
+
+	for _, s := range v.sorted() {
+		fmt.Fprintf(buf, "%s%s %s\n", v.name, formatLabels(v.labels, s.labelValues, "", ""), formatValue(s.value))
+	}
+}
+
+// Counter only goes up
+type Counter struct {
+	*vec
+}
+
+// NewCounter registers a counter with the given label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the counter for labelValues
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta, which must not be negative, to the counter for
+// labelValues
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.series(labelValues).value += delta
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	*vec
+}
+
+// NewGauge registers a gauge with the given label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// Set sets the gauge for labelValues
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.series(labelValues).value = value
+}
+
+// Add adds delta to the gauge for labelValues
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.series(labelValues).value += delta
+}
+
+// Inc adds one to the gauge for labelValues
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec takes one from the gauge for labelValues
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	*vec
+	buckets []float64
+}
+
+// NewHistogram registers a histogram with the given upper bounds, in
+// increasing order, and label names
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		vec:     newVec(name, help, "histogram", labels),
+		buckets: buckets,
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records value in the histogram for labelValues
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := h.series(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.buckets))
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.value++
+	s.sum += value
+}
+
+func (h *Histogram) write(buf *bytes.Buffer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.writeHeader(buf)
+
+	for _, s := range h.sorted() {
+		for i, bound := range h.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, "le", formatValue(bound)), s.buckets[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %s\n", h.name, formatLabels(h.labels, s.labelValues, "le", "+Inf"), formatValue(s.value))
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues, "", ""), formatValue(s.sum))
+		fmt.Fprintf(buf, "%s_count%s %s\n", h.name, formatLabels(h.labels, s.labelValues, "", ""), formatValue(s.value))
+	}
+}
+
+// formatLabels writes {name="value",...} with an optional extra label
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && len(extraName) == 0 {
+		return ""
+	}
+
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabel(values[i])))
+	}
+	if len(extraName) > 0 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, escapeLabel(extraValue)))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// accessPolicy restricts who may reach a host through the exit-node
+type accessPolicy struct {
+	// BasicAuth maps usernames to bcrypt hashes of their passwords
+	BasicAuth map[string]string `json:"basic_auth"`
+
+	// BearerTokens are accepted in the Authorization header
+	BearerTokens []string `json:"bearer_tokens"`
+
+	// AllowCIDRs limits the addresses requests may come from
+	AllowCIDRs []string `json:"allow_cidrs"`
+
+	// OIDC requires users to log in unless they present one of the
+	// credentials above
+	OIDC *oidcPolicy `json:"oidc"`
+
+	networks []*net.IPNet
+}
+
+// accessPolicies holds the policy for each host read from an access file
+type accessPolicies struct {
+	hosts map[string]*accessPolicy
+
+	// oidc logs users in for policies which require it
+	oidc *oidcProvider
+}
+
+// readAccessFile reads the policy for each host from an access file
+func readAccessFile(file string) (map[string]*accessPolicy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read access file: %s", err)
+	}
+
+	hosts := map[string]*accessPolicy{}
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return nil, fmt.Errorf("unable to parse access file %s: %s", file, err)
+	}
+	return hosts, nil
+}
+
+func newAccessPolicies(hosts map[string]*accessPolicy, oidc *oidcProvider) (*accessPolicies, error) {
+	policies := &accessPolicies{
+		hosts: make(map[string]*accessPolicy),
+		oidc:  oidc,
+	}
+	for host, policy := range hosts {
+		if policy.OIDC != nil && oidc == nil {
+			return nil, fmt.Errorf("give --oidc-issuer for the OIDC policy on %s", host)
+		}
+
+		for _, cidr := range policy.AllowCIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR for %s: %s", host, cidr)
+			}
+			policy.networks = append(policy.networks, network)
+		}
+
+		for user, hash := range policy.BasicAuth {
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return nil, fmt.Errorf("invalid bcrypt hash for %s on %s: %s", user, host, err)
+			}
+		}
+
+		policies.hosts[normalizeHost(host)] = policy
+	}
+
+	return policies, nil
+}
+
+// lookup finds the policy for host, trying the host itself, then wildcards
+// for each of its parent domains such as *.example.com and finally "*"
+func (a *accessPolicies) lookup(host string) *accessPolicy {
+	if a == nil {
+		return nil
+	}
+
+	for _, pattern := range hostPatterns(host) {
+		if policy, ok := a.hosts[pattern]; ok {
+			return policy
+		}
+	}
+	return nil
+}
+
+// check enforces the policy for the host of r, writing an error or a
+// login redirect to w and returning false when the request must not be
+// forwarded. Credentials checked by the policy are removed so that they
+// don't reach the upstream.
+func (a *accessPolicies) check(w http.ResponseWriter, r *http.Request) bool {
+	p := a.lookup(r.Host)
+	if p == nil {
+		return true
+	}
+
+	if len(p.networks) > 0 && !p.allowsAddr(r.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden"))
+		return false
+	}
+
+	if len(p.BasicAuth) == 0 && len(p.BearerTokens) == 0 && p.OIDC == nil {
+		return true
+	}
+
+	if p.allowsCredentials(r) {
+		r.Header.Del("Authorization")
+		return true
+	}
+
+	if p.OIDC != nil {
+		return a.oidc.gate(w, r, p.OIDC)
+	}
+
+	if len(p.BasicAuth) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="inlets"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("Unauthorized"))
+	return false
+}
+
+func (p *accessPolicy) allowsAddr(remoteAddr string) bool {
+	ip := net.ParseIP(remoteIP(remoteAddr))
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *accessPolicy) allowsCredentials(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		hash, ok := p.BasicAuth[user]
+		return ok && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	if bearer, ok := bearerToken(r); ok {
+		presented := sha256.Sum256([]byte(bearer))
+		for _, token := range p.BearerTokens {
+			expected := sha256.Sum256([]byte(token))
+			if subtle.ConstantTimeCompare(presented[:], expected[:]) == 1 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
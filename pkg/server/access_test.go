@@ -0,0 +1,58 @@
+package server
+
+import "testing"
+
+func TestAccessPolicyPrecedence(t *testing.T) {
+	hosts := map[string]*accessPolicy{
+		"*":                   {},
+		"example.com":         {},
+		"*.example.com":       {},
+		"*.dev.example.com":   {},
+		"api.dev.example.com": {},
+	}
+
+	names := map[*accessPolicy]string{}
+	for name, policy := range hosts {
+		names[policy] = name
+	}
+
+	access, err := newAccessPolicies(hosts, nil)
+	if err != nil {
+		t.Fatalf("access policies: %s", err)
+	}
+
+	tests := []struct {
+		host   string
+		policy string
+	}{
+		{"api.dev.example.com", "api.dev.example.com"},
+		{"API.dev.example.com.:443", "api.dev.example.com"},
+		{"web.dev.example.com", "*.dev.example.com"},
+		{"a.web.dev.example.com", "*.dev.example.com"},
+		{"dev.example.com", "*.example.com"},
+		{"example.com", "example.com"},
+		{"example.org", "*"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			if got := names[access.lookup(test.host)]; got != test.policy {
+				t.Fatalf("want the policy for %s, got %q", test.policy, got)
+			}
+		})
+	}
+}
+
+func TestAccessPolicyNoDefault(t *testing.T) {
+	access, err := newAccessPolicies(map[string]*accessPolicy{"*.example.com": {}}, nil)
+	if err != nil {
+		t.Fatalf("access policies: %s", err)
+	}
+
+	if p := access.lookup("example.org"); p != nil {
+		t.Fatalf("want no policy for a host which matches none, got %+v", p)
+	}
+	if p := access.lookup("example.com"); p != nil {
+		t.Fatalf("want a wildcard not to match its parent domain, got %+v", p)
+	}
+}
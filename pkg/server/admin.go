@@ -0,0 +1,163 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/logger"
+)
+
+// clientInfo describes a connected client in the admin API
+type clientInfo struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name,omitempty"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Hosts         []string  `json:"hosts"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+// requestInfo describes a request in flight in the admin API
+type requestInfo struct {
+	ID         string    `json:"id"`
+	ClientID   string    `json:"client_id"`
+	Host       string    `json:"host"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Started    time.Time `json:"started"`
+	AgeSeconds float64   `json:"age_seconds"`
+}
+
+// serveAdmin serves metrics and the admin API on the admin port, which is
+// kept apart from the public port so that it is never routed into a tunnel
+func (s *Server) serveAdmin(router *router, requests *activeRequests) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+
+	// The API can disconnect clients so it is only served with a token
+	if len(s.AdminToken) > 0 {
+		mux.HandleFunc("/clients", adminAuth(s.AdminToken, listClients(router)))
+		mux.HandleFunc("/clients/", adminAuth(s.AdminToken, disconnectClient(router)))
+		mux.HandleFunc("/requests", adminAuth(s.AdminToken, listRequests(requests)))
+	} else {
+		logger.Warnf("Admin API is disabled, give --admin-token to enable it")
+	}
+
+	logger.Infof("Serving admin on port %d", s.AdminPort)
+
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", s.AdminPort), mux); err != nil {
+		logger.Fatalf("%s", err)
+	}
+}
+
+// adminAuth only lets through requests with the admin token
+func adminAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	expected := sha256.Sum256([]byte(token))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		bearer, _ := bearerToken(r)
+		presented := sha256.Sum256([]byte(bearer))
+
+		if subtle.ConstantTimeCompare(presented[:], expected[:]) != 1 {
+			logger.Warnf("admin API request from %s with an invalid token", r.RemoteAddr)
+			http.Error(w, "Send admin token in header Authorization: Bearer <token>", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// listClients handles GET /clients
+func listClients(router *router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		clients := []clientInfo{}
+		for _, t := range router.list() {
+			clients = append(clients, clientInfo{
+				ID:            t.id,
+				Name:          t.name,
+				RemoteAddr:    t.remoteAddr,
+				Hosts:         t.hosts,
+				ConnectedAt:   t.connectedAt,
+				BytesSent:     t.session.BytesSent(),
+				BytesReceived: t.session.BytesReceived(),
+			})
+		}
+
+		sort.Slice(clients, func(i, j int) bool {
+			return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+		})
+
+		writeJSON(w, clients)
+	}
+}
+
+// disconnectClient handles DELETE /clients/{id}
+func disconnectClient(router *router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/clients/")
+
+		t := router.tunnel(id)
+		if t == nil {
+			http.Error(w, fmt.Sprintf("No client with id: %s", id), http.StatusNotFound)
+			return
+		}
+
+		logger.ID(t.id).Infof("disconnecting client %s through the admin API", t.remoteAddr)
+		t.session.Close()
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listRequests handles GET /requests
+func listRequests(requests *activeRequests) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		now := time.Now()
+
+		infos := []requestInfo{}
+		for _, req := range requests.list() {
+			infos = append(infos, requestInfo{
+				ID:         req.ID,
+				ClientID:   req.ClientID,
+				Host:       req.Host,
+				Method:     req.Method,
+				Path:       req.Path,
+				Started:    req.Started,
+				AgeSeconds: now.Sub(req.Started).Seconds(),
+			})
+		}
+
+		writeJSON(w, infos)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/logger"
+	"github.com/alexellis/inlets/pkg/token"
+	"github.com/alexellis/inlets/pkg/transport"
+)
+
+// identity is who a tunnel client authenticated as and the hostnames it
+// may serve
+type identity struct {
+	name string
+
+	// scopes each list the hosts the client may register, a host must be
+	// allowed by every scope so that a client which presents both a scoped
+	// token and a certificate is held to both
+	scopes [][]string
+}
+
+// restrict limits the hosts i may serve to those allowed by other as well
+func (i *identity) restrict(other *identity) {
+	if len(i.name) == 0 {
+		i.name = other.name
+	}
+	i.scopes = append(i.scopes, other.scopes...)
+}
+
+// allows reports whether the client may serve host. "*" in a scope allows
+// any host and "*.example.com" allows the subdomains of example.com.
+func (i *identity) allows(host string) bool {
+	for _, scope := range i.scopes {
+		if !scopeAllows(scope, host) {
+			return false
+		}
+	}
+	return true
+}
+
+func scopeAllows(scope []string, host string) bool {
+	for _, pattern := range scope {
+		if pattern == transport.DefaultUpstream || pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator checks the credentials presented by tunnel clients
+type authenticator struct {
+	token string
+
+	// tokens holds per-client tokens, the shared token is accepted as well
+	tokens *tokenStore
+
+	// secret verifies signed tokens issued with "inlets token issue"
+	secret []byte
+
+	// clientCerts requires a client certificate which was verified against
+	// the server's client CA
+	clientCerts bool
+
+	// revoked holds the serial numbers of revoked client certificates
+	revoked map[string]bool
+
+	// limiter bans IPs which repeatedly fail to authenticate
+	limiter *failureLimiter
+}
+
+func (s *Server) newAuthenticator() (*authenticator, error) {
+	a := &authenticator{
+		token:       s.Token,
+		secret:      []byte(s.TokenSecret),
+		clientCerts: len(s.ClientCAFile) > 0,
+		revoked:     make(map[string]bool),
+		limiter:     newFailureLimiter(s.MaxAuthFailures, s.AuthBanDuration),
+	}
+
+	if len(s.TokenFile) > 0 {
+		tokens, err := newTokenStore(s.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = tokens
+	}
+
+	if len(s.ClientCRLFile) > 0 {
+		if err := a.loadCRL(s.ClientCRLFile, s.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// authenticate returns the identity of the client making r, or an error to
+// give it with the status code. Failures are logged and count towards a
+// temporary ban of the client's IP.
+func (a *authenticator) authenticate(r *http.Request) (*identity, int, error) {
+	if remaining := a.limiter.banned(r.RemoteAddr); remaining > 0 {
+		logger.Warnf("client %s is banned for %s after repeated authentication failures", r.RemoteAddr, remaining.Round(time.Second))
+		return nil, http.StatusTooManyRequests, fmt.Errorf("Too many failed attempts, try again later")
+	}
+
+	id, reason, err := a.check(r)
+	if err != nil {
+		logger.Warnf("client %s failed to authenticate: %s", r.RemoteAddr, reason)
+		if a.limiter.fail(r.RemoteAddr) {
+			logger.Warnf("client %s is banned for %s", r.RemoteAddr, a.limiter.banDuration)
+		}
+		return nil, http.StatusUnauthorized, err
+	}
+
+	a.limiter.succeed(r.RemoteAddr)
+	return id, http.StatusOK, nil
+}
+
+// check verifies the credentials in r, on failure reason is logged and err
+// is given to the client
+func (a *authenticator) check(r *http.Request) (id *identity, reason string, err error) {
+	id = &identity{}
+
+	if len(a.token) > 0 || a.tokens != nil || len(a.secret) > 0 {
+		tokenErr := fmt.Errorf("Send token in header Authorization: Bearer <token>")
+
+		bearer, ok := bearerToken(r)
+		if !ok {
+			return nil, "no bearer token", tokenErr
+		}
+
+		// Hashing first means the comparison takes as long whatever the
+		// length of the token presented
+		presented, expected := sha256.Sum256([]byte(bearer)), sha256.Sum256([]byte(a.token))
+		valid := len(a.token) > 0 && subtle.ConstantTimeCompare(presented[:], expected[:]) == 1
+
+		if !valid && len(a.secret) > 0 && token.IsSigned(bearer) {
+			claims, err := token.Verify(a.secret, bearer, time.Now())
+			if err != nil {
+				return nil, err.Error(), tokenErr
+			}
+
+			hosts := []string{}
+			for _, host := range claims.Hosts {
+				hosts = append(hosts, normalizeHost(host))
+			}
+
+			id.restrict(&identity{name: claims.Subject, scopes: [][]string{hosts}})
+			valid = true
+		}
+
+		if !valid && a.tokens != nil {
+			tokenID, err := a.tokens.lookup(bearer)
+			if err != nil {
+				return nil, err.Error(), tokenErr
+			}
+
+			id.restrict(tokenID)
+			valid = true
+		}
+
+		if !valid {
+			return nil, "invalid token", tokenErr
+		}
+	}
+
+	if !a.clientCerts {
+		return id, "", nil
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, "no client certificate", fmt.Errorf("Send a client certificate signed by the server's client CA")
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if a.revoked[cert.SerialNumber.String()] {
+		return nil, fmt.Sprintf("client certificate %s has been revoked", cert.Subject.CommonName), fmt.Errorf("Client certificate has been revoked")
+	}
+
+	id.restrict(certIdentity(cert))
+	return id, "", nil
+}
+
+// bearerToken returns the token from the Authorization header of r
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) || len(auth) == len(prefix) {
+		return "", false
+	}
+	return auth[len(prefix):], true
+}
+
+// reload reads the token store again, tunnels which are already connected
+// are left as they are
+func (a *authenticator) reload() {
+	if a.tokens == nil {
+		return
+	}
+
+	if err := a.tokens.load(); err != nil {
+		logger.Errorf("unable to reload tokens: %s", err)
+		return
+	}
+	logger.Infof("reloaded %d tokens from %s", a.tokens.count(), a.tokens.path)
+}
+
+// certIdentity scopes a client certificate to its DNS names, or to its
+// common name when it has none. URIs such as tcp:2222 allow forwarded ports.
+func certIdentity(cert *x509.Certificate) *identity {
+	hosts := []string{}
+	for _, name := range cert.DNSNames {
+		hosts = append(hosts, normalizeHost(name))
+	}
+	for _, uri := range cert.URIs {
+		hosts = append(hosts, normalizeHost(uri.String()))
+	}
+
+	if len(hosts) == 0 && len(cert.Subject.CommonName) > 0 {
+		hosts = append(hosts, normalizeHost(cert.Subject.CommonName))
+	}
+
+	return &identity{
+		name:   cert.Subject.CommonName,
+		scopes: [][]string{hosts},
+	}
+}
+
+// loadCRL reads the revoked client certificates from a PEM or DER encoded
+// CRL which must be signed by one of the certificates in caFile
+func (a *authenticator) loadCRL(crlFile, caFile string) error {
+	data, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		return fmt.Errorf("unable to read client CRL: %s", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("unable to parse client CRL: %s", err)
+	}
+
+	cas, err := readCertificates(caFile)
+	if err != nil {
+		return err
+	}
+
+	signed := false
+	for _, ca := range cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("client CRL is not signed by the client CA")
+	}
+
+	for _, entry := range crl.RevokedCertificates {
+		a.revoked[entry.SerialNumber.String()] = true
+	}
+	return nil
+}
+
+// readCertificates parses every PEM encoded certificate in file
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client CA file: %s", err)
+	}
+
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse client CA file: %s", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in client CA file: %s", file)
+	}
+	return certs, nil
+}
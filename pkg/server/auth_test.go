@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/token"
+)
+
+func TestSignedTokenHostScope(t *testing.T) {
+	secret := []byte("secret")
+	a := &authenticator{secret: secret, revoked: map[string]bool{}}
+
+	bearer, err := token.Issue(secret, token.Claims{
+		Subject:   "laptop",
+		Hosts:     []string{"App.Example.com", "*.dev.example.com"},
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/tunnel", nil)
+	r.Header.Set("Authorization", "Bearer "+bearer)
+
+	id, reason, err := a.check(r)
+	if err != nil {
+		t.Fatalf("check: %s", reason)
+	}
+	if id.name != "laptop" {
+		t.Fatalf("want the client named laptop, got %s", id.name)
+	}
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"app.example.com", true},
+		{"api.dev.example.com", true},
+		{"other.example.com", false},
+		{"dev.example.com", false},
+	}
+	for _, test := range tests {
+		if got := id.allows(test.host); got != test.allowed {
+			t.Errorf("%s: want allowed %t, got %t", test.host, test.allowed, got)
+		}
+	}
+}
+
+func TestSignedTokenRejected(t *testing.T) {
+	secret := []byte("secret")
+
+	expired, _ := token.Issue(secret, token.Claims{Subject: "laptop", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	forged, _ := token.Issue([]byte("guessed"), token.Claims{Subject: "laptop", Hosts: []string{"*"}, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name   string
+		bearer string
+	}{
+		{"expired", expired},
+		{"signed by another secret", forged},
+		{"not a token", "a.b.c"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &authenticator{secret: secret, revoked: map[string]bool{}}
+
+			r := httptest.NewRequest(http.MethodGet, "/tunnel", nil)
+			r.Header.Set("Authorization", "Bearer "+test.bearer)
+
+			if _, _, err := a.check(r); err == nil {
+				t.Fatalf("want the token rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/transport"
+)
+
+// HostOptions overrides how requests for one public host are proxied. The
+// host may be a wildcard such as *.example.com, or "*" for every host.
+type HostOptions struct {
+	// GatewayTimeout replaces the server's GatewayTimeout when set
+	GatewayTimeout time.Duration
+
+	// RequestHeaders are set on requests before they go through the tunnel
+	RequestHeaders map[string]string
+
+	// ResponseHeaders are set on responses before they reach the caller
+	ResponseHeaders map[string]string
+
+	// BasicAuth, BearerTokens, AllowCIDRs and OIDCEmailDomains restrict who
+	// may reach the host in the same way as an entry in an access file
+	BasicAuth        map[string]string
+	BearerTokens     []string
+	AllowCIDRs       []string
+	OIDC             bool
+	OIDCEmailDomains []string
+}
+
+// hasAccessPolicy reports whether the options restrict access to the host
+func (o *HostOptions) hasAccessPolicy() bool {
+	return len(o.BasicAuth) > 0 || len(o.BearerTokens) > 0 || len(o.AllowCIDRs) > 0 || o.OIDC
+}
+
+func (o *HostOptions) accessPolicy() *accessPolicy {
+	policy := &accessPolicy{
+		BasicAuth:    o.BasicAuth,
+		BearerTokens: o.BearerTokens,
+		AllowCIDRs:   o.AllowCIDRs,
+	}
+	if o.OIDC {
+		policy.OIDC = &oidcPolicy{EmailDomains: o.OIDCEmailDomains}
+	}
+	return policy
+}
+
+// hostOptions finds the options for the host of a request
+type hostOptions struct {
+	hosts          map[string]*HostOptions
+	gatewayTimeout time.Duration
+}
+
+func newHostOptions(hosts map[string]HostOptions, gatewayTimeout time.Duration) (*hostOptions, error) {
+	options := &hostOptions{
+		hosts:          make(map[string]*HostOptions),
+		gatewayTimeout: gatewayTimeout,
+	}
+
+	for host, o := range hosts {
+		for name := range o.RequestHeaders {
+			if !ValidHeaderName(name) {
+				return nil, fmt.Errorf("invalid request header name for %s: %q", host, name)
+			}
+		}
+		for name := range o.ResponseHeaders {
+			if !ValidHeaderName(name) {
+				return nil, fmt.Errorf("invalid response header name for %s: %q", host, name)
+			}
+		}
+
+		o := o
+		options.hosts[normalizeHost(host)] = &o
+	}
+
+	return options, nil
+}
+
+// lookup finds the options for host in the same way as access policies,
+// it returns nil when there are none
+func (h *hostOptions) lookup(host string) *HostOptions {
+	for _, pattern := range hostPatterns(host) {
+		if o, ok := h.hosts[pattern]; ok {
+			return o
+		}
+	}
+	return nil
+}
+
+// timeout returns the gateway timeout for host
+func (h *hostOptions) timeout(host string) time.Duration {
+	if o := h.lookup(host); o != nil && o.GatewayTimeout > 0 {
+		return o.GatewayTimeout
+	}
+	return h.gatewayTimeout
+}
+
+// mergeAccessPolicies merges the access policies given in host options with
+// those from an access file, a host may only have one policy
+func mergeAccessPolicies(fromFile map[string]*accessPolicy, hosts map[string]HostOptions) (map[string]*accessPolicy, error) {
+	merged := map[string]*accessPolicy{}
+	for host, policy := range fromFile {
+		merged[normalizeHost(host)] = policy
+	}
+
+	for host, o := range hosts {
+		if !o.hasAccessPolicy() {
+			continue
+		}
+		if _, exists := merged[normalizeHost(host)]; exists {
+			return nil, fmt.Errorf("access to %s is given in both the access file and the host options", host)
+		}
+		merged[normalizeHost(host)] = o.accessPolicy()
+	}
+	return merged, nil
+}
+
+// setHeaders sets each of headers on header
+func setHeaders(header http.Header, headers map[string]string) {
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+}
+
+// hostPatterns lists the keys which may hold settings for host in order of
+// preference: the host itself, wildcards for each of its parent domains
+// such as *.example.com and finally "*"
+func hostPatterns(host string) []string {
+	host = normalizeHost(host)
+	patterns := []string{host}
+
+	for i := strings.Index(host, "."); i >= 0; i = strings.Index(host, ".") {
+		host = host[i+1:]
+		patterns = append(patterns, "*."+host)
+	}
+
+	return append(patterns, transport.DefaultUpstream)
+}
+
+// ValidHeaderName reports whether name may be used as an HTTP header name,
+// i.e. a token as defined by RFC 7230
+func ValidHeaderName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
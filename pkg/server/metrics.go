@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/logger"
+	"github.com/alexellis/inlets/pkg/metrics"
+	"github.com/alexellis/inlets/pkg/transport"
+	"github.com/twinj/uuid"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	requestsTotal = registry.NewCounter("inlets_server_requests_total",
+		"HTTP requests proxied by the exit-node.", "host", "method", "status")
+
+	requestDuration = registry.NewHistogram("inlets_server_request_duration_seconds",
+		"Time taken to proxy HTTP requests, including streaming the response.", metrics.DefaultBuckets, "host")
+
+	requestBytes = registry.NewCounter("inlets_server_request_bytes_total",
+		"Bytes of request bodies received from callers.", "host")
+
+	responseBytes = registry.NewCounter("inlets_server_response_bytes_total",
+		"Bytes of response bodies sent to callers.", "host")
+
+	gatewayTimeouts = registry.NewCounter("inlets_server_gateway_timeouts_total",
+		"Requests which timed out waiting for a response from the tunnel.", "host")
+
+	connectedClients = registry.NewGauge("inlets_server_connected_clients",
+		"Tunnel clients which are connected.")
+
+	clientConnections = registry.NewCounter("inlets_server_client_connections_total",
+		"Tunnel clients which have connected, including reconnections.")
+)
+
+// instrument gives each request handled by next an x-inlets-id, replacing
+// any sent by the caller, then records metrics and an access log line
+func instrument(router *router, accessLog bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		inletsID := uuid.Formatter(uuid.NewV4(), uuid.FormatHex)
+		r.Header.Set(transport.InletsHeader, inletsID)
+
+		host := hostLabel(router, r.Host)
+
+		// The client is looked up first as it may disconnect mid-request
+		clientID, clientName := "", ""
+		if t := router.lookup(r.Host); t != nil {
+			clientID, clientName = t.id, t.name
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		status := recorder.statusCode()
+		duration := time.Since(start)
+		received := atomic.LoadInt64(&body.n)
+
+		requestsTotal.Inc(host, methodLabel(r.Method), strconv.Itoa(status))
+		requestDuration.Observe(duration.Seconds(), host)
+		requestBytes.Add(float64(received), host)
+		responseBytes.Add(float64(recorder.written), host)
+
+		if accessLog {
+			logger.ID(inletsID).
+				With("remote_ip", remoteIP(r.RemoteAddr)).
+				With("host", r.Host).
+				With("method", r.Method).
+				With("path", r.URL.Path).
+				With("status", status).
+				With("request_bytes", received).
+				With("response_bytes", recorder.written).
+				With("duration", duration).
+				With("client_id", clientID).
+				With("client", clientName).
+				Infof("access")
+		}
+	}
+}
+
+// hostLabel only reports hosts which a client has registered, so that
+// callers can't grow the metrics without limit by sending made up hosts
+func hostLabel(router *router, host string) string {
+	host = normalizeHost(host)
+	if router.get(host) != nil {
+		return host
+	}
+	if router.get(transport.DefaultUpstream) != nil {
+		return transport.DefaultUpstream
+	}
+	return "unknown"
+}
+
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// responseRecorder remembers the status and size of a response while still
+// letting it be flushed and hijacked
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection does not support hijacking")
+	}
+
+	// Upgraded connections are reported as switching protocols
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+func (r *responseRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
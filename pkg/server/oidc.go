@@ -0,0 +1,569 @@
+package server
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/logger"
+	"github.com/alexellis/inlets/pkg/transport"
+)
+
+const (
+	// oidcCallbackPath is where the provider redirects back to on every
+	// host which requires a login
+	oidcCallbackPath = "/.inlets/oauth2/callback"
+
+	oidcSessionCookie = "inlets_session"
+	oidcStateCookie   = "inlets_oauth2_state"
+
+	// Cookie values are signed along with what they are for, so that a
+	// state cookie can't be presented as a session or the other way round
+	oidcSessionPurpose = "session"
+	oidcStatePurpose   = "state"
+
+	// oidcSessionDuration is how long a login lasts
+	oidcSessionDuration = 12 * time.Hour
+
+	// oidcLoginTimeout is how long a login may take at the provider
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// oidcPolicy requires an OpenID Connect login to reach a host
+type oidcPolicy struct {
+	// EmailDomains limits the users which may log in by the domain of their
+	// verified email address, any user of the provider is allowed when empty
+	EmailDomains []string `json:"email_domains"`
+}
+
+func (p *oidcPolicy) allows(email string) bool {
+	if len(p.EmailDomains) == 0 {
+		return true
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range p.EmailDomains {
+		if strings.ToLower(allowed) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcProvider logs users in with the authorization code flow and keeps
+// them logged in with a signed session cookie
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	sessionKey   []byte
+	client       *http.Client
+
+	// config and keys are discovered on first use so that the exit-node
+	// starts while the provider is unavailable
+	lock   sync.Mutex
+	config *oidcConfig
+	keys   map[string]*rsa.PublicKey
+}
+
+// oidcConfig is the part of the provider's discovery document in use
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcSession is held in the session cookie, it is only valid for the
+// host it was issued on
+type oidcSession struct {
+	Email   string `json:"email"`
+	Host    string `json:"host"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcState is held in a cookie while the user logs in at the provider
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"exp"`
+}
+
+func (s *Server) newOIDCProvider() (*oidcProvider, error) {
+	sessionKey := []byte(s.OIDCCookieSecret)
+
+	// Sessions end when the exit-node restarts without a cookie secret
+	if len(sessionKey) == 0 {
+		sessionKey = make([]byte, 32)
+		if _, err := rand.Read(sessionKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return &oidcProvider{
+		issuer:       strings.TrimSuffix(s.OIDCIssuer, "/"),
+		clientID:     s.OIDCClientID,
+		clientSecret: s.OIDCClientSecret,
+		sessionKey:   sessionKey,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// gate lets r through once its user has logged in and is allowed by
+// policy, adding their email address in the UserHeader. Otherwise it
+// sends the user to log in and returns false.
+func (o *oidcProvider) gate(w http.ResponseWriter, r *http.Request, policy *oidcPolicy) bool {
+	if r.URL.Path == oidcCallbackPath {
+		o.callback(w, r, policy)
+		return false
+	}
+
+	session := oidcSession{}
+	if cookie, err := r.Cookie(oidcSessionCookie); err == nil && o.verify(oidcSessionPurpose, cookie.Value, &session) == nil &&
+		session.Host == normalizeHost(r.Host) && time.Now().Unix() < session.Expires && policy.allows(session.Email) {
+
+		removeCookies(r, oidcSessionCookie, oidcStateCookie)
+		r.Header.Set(transport.UserHeader, session.Email)
+		return true
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized"))
+		return false
+	}
+
+	o.login(w, r)
+	return false
+}
+
+// login redirects to the provider, remembering where to return to
+func (o *oidcProvider) login(w http.ResponseWriter, r *http.Request) {
+	config, err := o.discover()
+	if err != nil {
+		logger.Errorf("unable to discover OIDC provider: %s", err)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Login is unavailable"))
+		return
+	}
+
+	state := oidcState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Redirect: r.URL.RequestURI(),
+		Expires:  time.Now().Add(oidcLoginTimeout).Unix(),
+	}
+
+	value, err := o.sign(oidcStatePurpose, state)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     oidcCallbackPath,
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.clientID},
+		"redirect_uri":  {callbackURL(r)},
+		"scope":         {"openid email"},
+		"state":         {state.State},
+		"nonce":         {state.Nonce},
+	}
+
+	http.Redirect(w, r, config.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+// callback completes a login by exchanging the code for an ID token
+func (o *oidcProvider) callback(w http.ResponseWriter, r *http.Request, policy *oidcPolicy) {
+	fail := func(status int, format string, args ...interface{}) {
+		logger.Warnf("OIDC login on %s failed: %s", r.Host, fmt.Sprintf(format, args...))
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status)))
+	}
+
+	state := oidcState{}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || o.verify(oidcStatePurpose, cookie.Value, &state) != nil {
+		fail(http.StatusBadRequest, "no login in progress")
+		return
+	}
+
+	if time.Now().Unix() >= state.Expires || !hmac.Equal([]byte(r.URL.Query().Get("state")), []byte(state.State)) {
+		fail(http.StatusBadRequest, "state does not match")
+		return
+	}
+
+	if reason := r.URL.Query().Get("error"); len(reason) > 0 {
+		fail(http.StatusForbidden, "provider returned %s", reason)
+		return
+	}
+
+	email, err := o.exchange(r.URL.Query().Get("code"), callbackURL(r), state.Nonce)
+	if err != nil {
+		fail(http.StatusBadGateway, "%s", err)
+		return
+	}
+
+	if !policy.allows(email) {
+		fail(http.StatusForbidden, "%s is not in an allowed email domain", email)
+		return
+	}
+
+	value, err := o.sign(oidcSessionPurpose, oidcSession{
+		Email:   email,
+		Host:    normalizeHost(r.Host),
+		Expires: time.Now().Add(oidcSessionDuration).Unix(),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(oidcSessionDuration.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: oidcCallbackPath, MaxAge: -1})
+
+	logger.Infof("OIDC login on %s for %s", r.Host, email)
+
+	// Only redirect within the host, never to another site
+	redirect := state.Redirect
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// exchange swaps code for an ID token and returns its verified email
+func (o *oidcProvider) exchange(code, redirectURI, nonce string) (string, error) {
+	config, err := o.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+
+	res, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return "", fmt.Errorf("token endpoint returned %s: %s", res.Status, body)
+	}
+
+	tokens := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("unable to parse token response: %s", err)
+	}
+
+	claims := struct {
+		Issuer        string          `json:"iss"`
+		Audience      json.RawMessage `json:"aud"`
+		Expires       int64           `json:"exp"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified *bool           `json:"email_verified"`
+	}{}
+	if err := o.verifyIDToken(tokens.IDToken, &claims); err != nil {
+		return "", err
+	}
+
+	if claims.Issuer != config.Issuer {
+		return "", fmt.Errorf("ID token issued by %s", claims.Issuer)
+	}
+	if !audienceContains(claims.Audience, o.clientID) {
+		return "", fmt.Errorf("ID token is not for client %s", o.clientID)
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return "", fmt.Errorf("ID token has expired")
+	}
+	if !hmac.Equal([]byte(claims.Nonce), []byte(nonce)) {
+		return "", fmt.Errorf("ID token nonce does not match")
+	}
+	if len(claims.Email) == 0 || (claims.EmailVerified != nil && !*claims.EmailVerified) {
+		return "", fmt.Errorf("ID token has no verified email")
+	}
+
+	return claims.Email, nil
+}
+
+// verifyIDToken checks the RS256 signature of an ID token against the
+// provider's keys and decodes its claims
+func (o *oidcProvider) verifyIDToken(token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed ID token")
+	}
+
+	head, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("malformed ID token header")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := json.Unmarshal(head, &header); err != nil || header.Alg != "RS256" {
+		return fmt.Errorf("unsupported ID token algorithm")
+	}
+
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed ID token signature")
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("invalid ID token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed ID token claims")
+	}
+	return json.Unmarshal(payload, claims)
+}
+
+// discover fetches the provider's discovery document once
+func (o *oidcProvider) discover() (*oidcConfig, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.config != nil {
+		return o.config, nil
+	}
+
+	config := &oidcConfig{}
+	if err := o.getJSON(o.issuer+"/.well-known/openid-configuration", config); err != nil {
+		return nil, err
+	}
+
+	if len(config.AuthorizationEndpoint) == 0 || len(config.TokenEndpoint) == 0 || len(config.JWKSURI) == 0 {
+		return nil, fmt.Errorf("discovery document for %s is incomplete", o.issuer)
+	}
+
+	o.config = config
+	return config, nil
+}
+
+// key returns the provider's signing key kid, fetching the keys again
+// when it is unknown so that rotated keys are picked up
+func (o *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	config, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+
+	jwks := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	if err := o.getJSON(config.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	o.keys = keys
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown ID token key: %s", kid)
+	}
+	return key, nil
+}
+
+func (o *oidcProvider) getJSON(uri string, v interface{}) error {
+	res, err := o.client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", uri, res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("unable to parse %s: %s", uri, err)
+	}
+	return nil
+}
+
+// sign encodes v as a cookie value for purpose which can't be altered by
+// the browser
+func (o *oidcProvider) sign(purpose string, v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(o.mac(purpose, encoded)), nil
+}
+
+// verify decodes a cookie value made by sign for the same purpose into v
+func (o *oidcProvider) verify(purpose, value string, v interface{}) error {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return fmt.Errorf("malformed cookie")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed cookie")
+	}
+
+	if !hmac.Equal(signature, o.mac(purpose, parts[0])) {
+		return fmt.Errorf("invalid cookie signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("malformed cookie")
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// mac signs the purpose and the encoded payload of a cookie, the purpose
+// can't contain the separator so the two can't be shifted into each other
+func (o *oidcProvider) mac(purpose, encoded string) []byte {
+	mac := hmac.New(sha256.New, o.sessionKey)
+	mac.Write([]byte(purpose + "." + encoded))
+	return mac.Sum(nil)
+}
+
+// callbackURL is the redirect URI registered with the provider for the
+// host of r
+func callbackURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + oidcCallbackPath
+}
+
+// audienceContains checks the aud claim, which is a string or a list
+func audienceContains(aud json.RawMessage, clientID string) bool {
+	single := ""
+	if json.Unmarshal(aud, &single) == nil {
+		return single == clientID
+	}
+
+	list := []string{}
+	if json.Unmarshal(aud, &list) == nil {
+		for _, value := range list {
+			if value == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeCookies stops the exit-node's own cookies reaching the upstream
+func removeCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+
+	for _, cookie := range cookies {
+		keep := true
+		for _, name := range names {
+			if cookie.Name == name {
+				keep = false
+			}
+		}
+		if keep {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+func randomString() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,363 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/transport"
+)
+
+// mockProvider is a stand-in OIDC provider which issues an ID token with
+// the claims set by the test for any code
+type mockProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	// claims are issued by the token endpoint, signed with signer and
+	// naming tokenKid when they are set
+	claims   map[string]interface{}
+	signer   *rsa.PrivateKey
+	tokenKid string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+
+	p := &mockProvider{key: key, kid: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcConfig{
+			Issuer:                p.server.URL,
+			AuthorizationEndpoint: p.server.URL + "/authorize",
+			TokenEndpoint:         p.server.URL + "/token",
+			JWKSURI:               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": p.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "inlets" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("grant_type") != "authorization_code" || r.FormValue("code") != "code-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.token(t)})
+	})
+
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// token signs the configured claims as an RS256 JWT
+func (p *mockProvider) token(t *testing.T) string {
+	signer, kid := p.key, p.kid
+	if p.signer != nil {
+		signer = p.signer
+	}
+	if len(p.tokenKid) > 0 {
+		kid = p.tokenKid
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	claims, _ := json.Marshal(p.claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Errorf("sign: %s", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTestOIDCProvider(t *testing.T, issuer string) *oidcProvider {
+	t.Helper()
+
+	o, err := (&Server{OIDCIssuer: issuer, OIDCClientID: "inlets", OIDCClientSecret: "secret"}).newOIDCProvider()
+	if err != nil {
+		t.Fatalf("new provider: %s", err)
+	}
+	return o
+}
+
+// startLogin sends an unauthenticated request through the gate and returns
+// the state cookie along with the state and nonce sent to the provider
+func startLogin(t *testing.T, o *oidcProvider, policy *oidcPolicy) (*http.Cookie, string, string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	if o.gate(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/private?page=2", nil), policy) {
+		t.Fatalf("want a login before reaching the upstream")
+	}
+	if w.Code != http.StatusFound {
+		t.Fatalf("want a redirect to the provider, got %d", w.Code)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parse location: %s", err)
+	}
+	query := location.Query()
+	if query.Get("client_id") != "inlets" || query.Get("redirect_uri") != "http://app.example.com"+oidcCallbackPath {
+		t.Fatalf("unexpected authorization request: %s", location)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie {
+		t.Fatalf("want the state cookie, got %v", cookies)
+	}
+	return cookies[0], query.Get("state"), query.Get("nonce")
+}
+
+func callbackRequest(state string, cookie *http.Cookie) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://app.example.com"+oidcCallbackPath+"?code=code-1&state="+state, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newMockProvider(t)
+	o := newTestOIDCProvider(t, provider.server.URL+"/")
+	policy := &oidcPolicy{EmailDomains: []string{"Example.com"}}
+
+	stateCookie, state, nonce := startLogin(t, o, policy)
+	provider.claims = map[string]interface{}{
+		"iss":   provider.server.URL,
+		"aud":   []string{"other", "inlets"},
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": nonce,
+		"email": "alex@example.com",
+	}
+
+	w := httptest.NewRecorder()
+	o.gate(w, callbackRequest(state, stateCookie), policy)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/private?page=2" {
+		t.Fatalf("want a redirect back to the page, got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+
+	var session *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcSessionCookie {
+			session = cookie
+		}
+	}
+	if session == nil {
+		t.Fatalf("want a session cookie")
+	}
+
+	// The session lets requests through with the user's email, and is
+	// kept from the upstream along with any spoofed user header
+	r := httptest.NewRequest(http.MethodGet, "http://app.example.com/private", nil)
+	r.AddCookie(session)
+	r.AddCookie(&http.Cookie{Name: "app", Value: "kept"})
+	r.Header.Set(transport.UserHeader, "admin@example.com")
+
+	if !o.gate(httptest.NewRecorder(), r, policy) {
+		t.Fatalf("want the request let through with the session")
+	}
+	if got := r.Header.Get(transport.UserHeader); got != "alex@example.com" {
+		t.Fatalf("want the user alex@example.com, got %s", got)
+	}
+	if _, err := r.Cookie(oidcSessionCookie); err == nil {
+		t.Fatalf("want the session cookie removed")
+	}
+	if _, err := r.Cookie("app"); err != nil {
+		t.Fatalf("want the upstream's cookie kept")
+	}
+
+	// The session is only valid for the host it was issued on
+	r = httptest.NewRequest(http.MethodGet, "http://other.example.com/", nil)
+	r.AddCookie(session)
+	if o.gate(httptest.NewRecorder(), r, policy) {
+		t.Fatalf("want the session refused on another host")
+	}
+
+	// Nor is it valid once the policy no longer allows the user
+	r = httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	r.AddCookie(session)
+	if o.gate(httptest.NewRecorder(), r, &oidcPolicy{EmailDomains: []string{"example.org"}}) {
+		t.Fatalf("want the session refused for a disallowed domain")
+	}
+}
+
+func TestOIDCCallbackRejectsIDTokens(t *testing.T) {
+	valid := func(p *mockProvider, nonce string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   p.server.URL,
+			"aud":   "inlets",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": nonce,
+			"email": "alex@example.com",
+		}
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(p *mockProvider, claims map[string]interface{})
+		want   int
+	}{
+		{"other issuer", func(p *mockProvider, c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, http.StatusBadGateway},
+		{"other audience", func(p *mockProvider, c map[string]interface{}) { c["aud"] = []string{"other"} }, http.StatusBadGateway},
+		{"expired", func(p *mockProvider, c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, http.StatusBadGateway},
+		{"other nonce", func(p *mockProvider, c map[string]interface{}) { c["nonce"] = "replayed" }, http.StatusBadGateway},
+		{"unverified email", func(p *mockProvider, c map[string]interface{}) { c["email_verified"] = false }, http.StatusBadGateway},
+		{"no email", func(p *mockProvider, c map[string]interface{}) { delete(c, "email") }, http.StatusBadGateway},
+		{"signed by another key", func(p *mockProvider, c map[string]interface{}) { p.signer = otherKey }, http.StatusBadGateway},
+		{"unknown key", func(p *mockProvider, c map[string]interface{}) { p.tokenKid = "key-2" }, http.StatusBadGateway},
+		{"email domain not allowed", func(p *mockProvider, c map[string]interface{}) { c["email"] = "alex@example.org" }, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newMockProvider(t)
+			o := newTestOIDCProvider(t, provider.server.URL)
+			policy := &oidcPolicy{EmailDomains: []string{"example.com"}}
+
+			stateCookie, state, nonce := startLogin(t, o, policy)
+			provider.claims = valid(provider, nonce)
+			test.change(provider, provider.claims)
+
+			w := httptest.NewRecorder()
+			o.gate(w, callbackRequest(state, stateCookie), policy)
+			if w.Code != test.want {
+				t.Fatalf("want %d, got %d", test.want, w.Code)
+			}
+			for _, cookie := range w.Result().Cookies() {
+				if cookie.Name == oidcSessionCookie {
+					t.Fatalf("want no session cookie")
+				}
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRejectsState(t *testing.T) {
+	provider := newMockProvider(t)
+	o := newTestOIDCProvider(t, provider.server.URL)
+	policy := &oidcPolicy{}
+
+	stateCookie, state, _ := startLogin(t, o, policy)
+
+	// A session cookie is signed with the same key, but not as a state
+	session, err := o.sign(oidcSessionPurpose, oidcState{State: state, Expires: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		state  string
+		cookie *http.Cookie
+	}{
+		{"no state cookie", state, nil},
+		{"other state", "guessed", stateCookie},
+		{"altered state cookie", state, &http.Cookie{Name: oidcStateCookie, Value: "x" + stateCookie.Value}},
+		{"session cookie as state", state, &http.Cookie{Name: oidcStateCookie, Value: session}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			o.gate(w, callbackRequest(test.state, test.cookie), policy)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("want %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
+
+func TestOIDCStateCookieIsNotASession(t *testing.T) {
+	o := newTestOIDCProvider(t, "https://login.example.com")
+
+	// A state cookie holds an exp claim too, but can't be used to log in
+	state, err := o.sign(oidcStatePurpose, oidcSession{
+		Email:   "alex@example.com",
+		Host:    "app.example.com",
+		Expires: time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "http://app.example.com/", nil)
+	r.AddCookie(&http.Cookie{Name: oidcSessionCookie, Value: state})
+
+	w := httptest.NewRecorder()
+	if o.gate(w, r, &oidcPolicy{}) {
+		t.Fatalf("want a state cookie refused as a session")
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("want %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestOIDCPolicyAllows(t *testing.T) {
+	tests := []struct {
+		domains []string
+		email   string
+		want    bool
+	}{
+		{nil, "alex@example.org", true},
+		{[]string{"example.com"}, "alex@EXAMPLE.com", true},
+		{[]string{"example.com"}, "alex@example.com.evil.org", false},
+		{[]string{"example.com"}, "alex@sub.example.com", false},
+		{[]string{"example.com"}, "example.com", false},
+	}
+
+	for _, test := range tests {
+		if got := (&oidcPolicy{EmailDomains: test.domains}).allows(test.email); got != test.want {
+			t.Errorf("%v allows %s: want %t, got %t", test.domains, test.email, test.want, got)
+		}
+	}
+}
+
+func TestOIDCLoginWhenProviderIsDown(t *testing.T) {
+	provider := newMockProvider(t)
+	o := newTestOIDCProvider(t, provider.server.URL)
+	provider.server.Close()
+
+	w := httptest.NewRecorder()
+	if o.gate(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil), &oidcPolicy{}) {
+		t.Fatalf("want no request let through")
+	}
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "unavailable") {
+		t.Fatalf("want %d, got %d: %s", http.StatusBadGateway, w.Code, w.Body)
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/logger"
+	"github.com/alexellis/inlets/pkg/transport"
+	"github.com/twinj/uuid"
+)
+
+// portListeners listens on the ports claimed by clients through tcp: and
+// udp: upstreams and forwards traffic through the tunnel of the client
+// which claimed each port
+type portListeners struct {
+	router         *router
+	udpIdleTimeout time.Duration
+
+	lock      sync.Mutex
+	listeners map[string]io.Closer
+	closed    bool
+}
+
+func newPortListeners(router *router, udpIdleTimeout time.Duration) *portListeners {
+	return &portListeners{
+		router:         router,
+		udpIdleTimeout: udpIdleTimeout,
+		listeners:      make(map[string]io.Closer),
+	}
+}
+
+// open starts listening on any tcp: or udp: ports in hosts which are not
+// already being listened on
+func (l *portListeners) open(hosts []string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	for _, host := range hosts {
+		network, port := parsePort(host)
+		if len(network) == 0 {
+			continue
+		}
+
+		if _, ok := l.listeners[host]; ok {
+			continue
+		}
+
+		if port <= 0 || port > 65535 {
+			logger.Errorf("Invalid port requested: %s", host)
+			continue
+		}
+
+		addr := ":" + strconv.Itoa(port)
+
+		switch network {
+		case "tcp":
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				logger.Errorf("Unable to listen for %s: %s", host, err)
+				continue
+			}
+
+			logger.Infof("Forwarding TCP connections on port %d", port)
+
+			l.listeners[host] = ln
+			go l.serveTCP(host, ln)
+		case "udp":
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				logger.Errorf("Unable to listen for %s: %s", host, err)
+				continue
+			}
+
+			logger.Infof("Forwarding UDP datagrams on port %d", port)
+
+			relay := newUDPRelay(host, conn, l.router, l.udpIdleTimeout)
+			l.listeners[host] = relay
+			go relay.serve()
+		}
+	}
+}
+
+// release stops listening on any ports in hosts which are no longer
+// claimed by a connected client
+func (l *portListeners) release(hosts []string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, host := range hosts {
+		ln, ok := l.listeners[host]
+		if !ok || l.router.get(host) != nil {
+			continue
+		}
+
+		logger.Infof("Closing listener for %s", host)
+
+		ln.Close()
+		delete(l.listeners, host)
+	}
+}
+
+// close stops listening on every port, connections already forwarded are
+// left to end with their tunnel
+func (l *portListeners) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for host, ln := range l.listeners {
+		ln.Close()
+		delete(l.listeners, host)
+	}
+	l.closed = true
+}
+
+func (l *portListeners) serveTCP(host string, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go l.forwardTCP(host, conn)
+	}
+}
+
+func (l *portListeners) forwardTCP(host string, conn net.Conn) {
+	defer conn.Close()
+
+	inletsID := uuid.Formatter(uuid.NewV4(), uuid.FormatHex)
+
+	t := l.router.get(host)
+	if t == nil {
+		logger.ID(inletsID).Warnf("no client connected for %s", host)
+		return
+	}
+
+	stream, err := t.session.Open(inletsID, host)
+	if err != nil {
+		logger.ID(inletsID).Errorf("unable to open stream: %s", err)
+		return
+	}
+	defer stream.Reset()
+
+	logger.ID(inletsID).Debugf("forwarding %s from %s", host, conn.RemoteAddr())
+
+	transport.Pipe(conn, stream)
+
+	logger.ID(inletsID).Debugf("connection from %s closed", conn.RemoteAddr())
+}
+
+// parsePort splits a tcp: or udp: upstream into its network and port, the
+// network is empty for any other upstream
+func parsePort(host string) (network string, port int) {
+	for _, prefix := range []string{transport.TCPPrefix, transport.UDPPrefix} {
+		if strings.HasPrefix(host, prefix) {
+			port, err := strconv.Atoi(strings.TrimPrefix(host, prefix))
+			if err != nil {
+				port = -1
+			}
+			return strings.TrimSuffix(prefix, ":"), port
+		}
+	}
+	return "", 0
+}
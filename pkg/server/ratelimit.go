@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxAuthFailures is used when the server has no MaxAuthFailures set
+	defaultMaxAuthFailures = 5
+
+	// defaultAuthBanDuration is used when the server has no AuthBanDuration set
+	defaultAuthBanDuration = 5 * time.Minute
+)
+
+// failureLimiter bans a remote IP for banDuration once it has failed to
+// authenticate maxFailures times within banDuration of its first failure
+type failureLimiter struct {
+	maxFailures int
+	banDuration time.Duration
+
+	lock      sync.Mutex
+	entries   map[string]*failures
+	lastPrune time.Time
+}
+
+type failures struct {
+	count       int
+	first       time.Time
+	bannedUntil time.Time
+}
+
+func newFailureLimiter(maxFailures int, banDuration time.Duration) *failureLimiter {
+	if maxFailures <= 0 {
+		maxFailures = defaultMaxAuthFailures
+	}
+	if banDuration <= 0 {
+		banDuration = defaultAuthBanDuration
+	}
+
+	return &failureLimiter{
+		maxFailures: maxFailures,
+		banDuration: banDuration,
+		entries:     make(map[string]*failures),
+	}
+}
+
+// banned returns how long the IP of remoteAddr remains banned for, or zero
+func (f *failureLimiter) banned(remoteAddr string) time.Duration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	entry, ok := f.entries[remoteIP(remoteAddr)]
+	if !ok {
+		return 0
+	}
+
+	if remaining := time.Until(entry.bannedUntil); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// fail records a failed attempt from remoteAddr and reports whether its IP
+// is now banned
+func (f *failureLimiter) fail(remoteAddr string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := time.Now()
+	f.prune(now)
+
+	ip := remoteIP(remoteAddr)
+	entry, ok := f.entries[ip]
+	if !ok || now.Sub(entry.first) > f.banDuration {
+		entry = &failures{first: now}
+		f.entries[ip] = entry
+	}
+
+	entry.count++
+	if entry.count >= f.maxFailures {
+		entry.bannedUntil = now.Add(f.banDuration)
+		return true
+	}
+	return false
+}
+
+// succeed forgets the failures of remoteAddr's IP
+func (f *failureLimiter) succeed(remoteAddr string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.entries, remoteIP(remoteAddr))
+}
+
+// prune drops the entries which no longer count towards a ban, so that the
+// map doesn't grow with every IP that ever failed
+func (f *failureLimiter) prune(now time.Time) {
+	if now.Sub(f.lastPrune) < time.Minute {
+		return
+	}
+	f.lastPrune = now
+
+	for ip, entry := range f.entries {
+		if now.Sub(entry.first) > f.banDuration && now.After(entry.bannedUntil) {
+			delete(f.entries, ip)
+		}
+	}
+}
+
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
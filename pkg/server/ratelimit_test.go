@@ -0,0 +1,67 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailureLimiterLockout(t *testing.T) {
+	tests := []struct {
+		name   string
+		fails  []string
+		check  string
+		banned bool
+	}{
+		{"under the limit", []string{"10.0.0.1:1000", "10.0.0.1:1001"}, "10.0.0.1:1002", false},
+		{"at the limit from any port", []string{"10.0.0.1:1000", "10.0.0.1:1001", "10.0.0.1:1002"}, "10.0.0.1:1003", true},
+		{"another IP", []string{"10.0.0.1:1000", "10.0.0.1:1001", "10.0.0.1:1002"}, "10.0.0.2:1000", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFailureLimiter(3, time.Hour)
+			for _, addr := range test.fails {
+				f.fail(addr)
+			}
+
+			if got := f.banned(test.check) > 0; got != test.banned {
+				t.Fatalf("want banned %t, got %t", test.banned, got)
+			}
+		})
+	}
+}
+
+func TestFailureLimiterSucceedForgets(t *testing.T) {
+	f := newFailureLimiter(3, time.Hour)
+	f.fail("10.0.0.1:1000")
+	f.fail("10.0.0.1:1000")
+	f.succeed("10.0.0.1:1000")
+
+	if f.fail("10.0.0.1:1000") {
+		t.Fatalf("want the failures before a success forgotten")
+	}
+}
+
+func TestFailureLimiterUnlock(t *testing.T) {
+	window := 100 * time.Millisecond
+	f := newFailureLimiter(2, window)
+
+	f.fail("10.0.0.1:1000")
+	if !f.fail("10.0.0.1:1000") {
+		t.Fatalf("want the IP banned at the limit")
+	}
+	if remaining := f.banned("10.0.0.1:1000"); remaining <= 0 || remaining > window {
+		t.Fatalf("want a ban of up to %s, got %s", window, remaining)
+	}
+
+	time.Sleep(window + 20*time.Millisecond)
+
+	if remaining := f.banned("10.0.0.1:1000"); remaining != 0 {
+		t.Fatalf("want the ban lifted after %s, got %s left", window, remaining)
+	}
+
+	// The failures which led to the ban no longer count towards another
+	if f.fail("10.0.0.1:1000") {
+		t.Fatalf("want a fresh count once the window has passed")
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// activeRequest is a request which is being proxied through a tunnel
+type activeRequest struct {
+	ID       string
+	ClientID string
+	Host     string
+	Method   string
+	Path     string
+	Started  time.Time
+}
+
+// activeRequests tracks the requests in flight for the admin API
+type activeRequests struct {
+	lock     sync.Mutex
+	requests map[string]*activeRequest
+}
+
+func newActiveRequests() *activeRequests {
+	return &activeRequests{
+		requests: make(map[string]*activeRequest),
+	}
+}
+
+func (a *activeRequests) add(req *activeRequest) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.requests[req.ID] = req
+}
+
+func (a *activeRequests) remove(id string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.requests, id)
+}
+
+// list returns the requests in flight, oldest first
+func (a *activeRequests) list() []*activeRequest {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	requests := make([]*activeRequest, 0, len(a.requests))
+	for _, req := range a.requests {
+		requests = append(requests, req)
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Started.Before(requests[j].Started)
+	})
+	return requests
+}
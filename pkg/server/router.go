@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/transport"
+)
+
+// tunnel is a connected client and the hostnames it serves
+type tunnel struct {
+	id          string
+	name        string
+	remoteAddr  string
+	hosts       []string
+	session     *transport.Session
+	connectedAt time.Time
+}
+
+// alive reports whether the tunnel's connection is still up, it is removed
+// from the router shortly after it drops
+func (t *tunnel) alive() bool {
+	select {
+	case <-t.session.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// available reports whether new requests can be routed to the tunnel, which
+// is not the case once the client has said it is going away
+func (t *tunnel) available() bool {
+	select {
+	case <-t.session.GoingAway():
+		return false
+	default:
+		return t.alive()
+	}
+}
+
+var (
+	errNoClient       = errors.New("no tunnel client is connected")
+	errTooManyWaiting = errors.New("too many requests are waiting for a tunnel client")
+)
+
+// router maps hostnames to the connected client which serves them
+type router struct {
+	lock    sync.RWMutex
+	hosts   map[string]*tunnel
+	tunnels map[string]*tunnel
+
+	// added is closed and replaced whenever a client connects, to wake up
+	// requests waiting for one
+	added chan struct{}
+
+	// waitTimeout is how long a request waits for a client to connect,
+	// with at most maxWaiting requests waiting at once
+	waitTimeout time.Duration
+	maxWaiting  int
+	waiting     int
+}
+
+func newRouter(waitTimeout time.Duration, maxWaiting int) *router {
+	return &router{
+		hosts:       make(map[string]*tunnel),
+		tunnels:     make(map[string]*tunnel),
+		added:       make(chan struct{}),
+		waitTimeout: waitTimeout,
+		maxWaiting:  maxWaiting,
+	}
+}
+
+// add registers t for each of its hosts, replacing any client which was
+// previously serving the same host so that a reconnecting client takes
+// over from its stale connection.
+func (r *router) add(t *tunnel) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, host := range t.hosts {
+		r.hosts[host] = t
+	}
+	r.tunnels[t.id] = t
+
+	close(r.added)
+	r.added = make(chan struct{})
+}
+
+// remove unregisters any hosts still owned by t.
+func (r *router) remove(t *tunnel) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, host := range t.hosts {
+		if r.hosts[host] == t {
+			delete(r.hosts, host)
+		}
+	}
+	delete(r.tunnels, t.id)
+}
+
+// lookup finds the client serving host, falling back to a client which
+// registered as the default upstream. Clients whose connection has dropped
+// or which are going away are skipped.
+func (r *router) lookup(host string) *tunnel {
+	host = normalizeHost(host)
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.lookupLocked(host)
+}
+
+func (r *router) lookupLocked(host string) *tunnel {
+	if t, ok := r.hosts[host]; ok && t.available() {
+		return t
+	}
+	if t, ok := r.hosts[transport.DefaultUpstream]; ok && t.available() {
+		return t
+	}
+	return nil
+}
+
+// wait finds the client serving host like lookup, but when there is none
+// waits up to waitTimeout for one to connect, such as a client which is
+// reconnecting. It gives up straight away when maxWaiting requests are
+// already waiting, or once ctx is done.
+func (r *router) wait(ctx context.Context, host string) (*tunnel, error) {
+	host = normalizeHost(host)
+
+	r.lock.Lock()
+	if t := r.lookupLocked(host); t != nil {
+		r.lock.Unlock()
+		return t, nil
+	}
+
+	if r.waitTimeout <= 0 {
+		r.lock.Unlock()
+		return nil, errNoClient
+	}
+	if r.waiting >= r.maxWaiting {
+		r.lock.Unlock()
+		return nil, errTooManyWaiting
+	}
+
+	r.waiting++
+	added := r.added
+	r.lock.Unlock()
+
+	defer func() {
+		r.lock.Lock()
+		r.waiting--
+		r.lock.Unlock()
+	}()
+
+	timer := time.NewTimer(r.waitTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-added:
+		case <-timer.C:
+			return nil, errNoClient
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		r.lock.RLock()
+		t := r.lookupLocked(host)
+		added = r.added
+		r.lock.RUnlock()
+
+		if t != nil {
+			return t, nil
+		}
+	}
+}
+
+// get finds the client which registered key, without falling back to
+// the default upstream
+func (r *router) get(key string) *tunnel {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.hosts[key]
+}
+
+// tunnel finds a connected client by its id
+func (r *router) tunnel(id string) *tunnel {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.tunnels[id]
+}
+
+// list returns every connected client, including those whose hosts have
+// all been taken over by another client
+func (r *router) list() []*tunnel {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	tunnels := make([]*tunnel, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+// parseHosts reads the hostnames advertised by a client when connecting
+func parseHosts(header http.Header) []string {
+	hosts := []string{}
+	for _, value := range header[http.CanonicalHeaderKey(transport.UpstreamHeader)] {
+		for _, host := range strings.Split(value, ",") {
+			host = normalizeHost(host)
+			if len(host) > 0 {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	// Older clients do not advertise hosts, treat them as the default
+	if len(hosts) == 0 {
+		hosts = append(hosts, transport.DefaultUpstream)
+	}
+	return hosts
+}
+
+// normalizeHost gives the canonical form of a hostname for routing, host
+// options, access policies and logins, so that none of them can be skipped
+// by writing the same host another way such as with a trailing dot
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if strings.HasPrefix(host, transport.TCPPrefix) || strings.HasPrefix(host, transport.UDPPrefix) {
+		return host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
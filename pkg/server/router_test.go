@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/transport"
+	"github.com/gorilla/websocket"
+)
+
+// newTestTunnel connects a session over a websocket for a client serving
+// hosts, the peer's session is returned to close the connection from the
+// client's side
+func newTestTunnel(t *testing.T, id string, hosts ...string) (*tunnel, *transport.Session) {
+	t.Helper()
+
+	accepted := make(chan *transport.Session, 1)
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %s", err)
+			return
+		}
+		accepted <- transport.NewSession(ws)
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+
+	client := transport.NewSession(ws)
+	session := <-accepted
+
+	for _, s := range []*transport.Session{client, session} {
+		s := s
+		go s.Serve()
+		t.Cleanup(func() { s.Close() })
+	}
+
+	return &tunnel{id: id, hosts: hosts, session: session}, client
+}
+
+func TestHostWrittenAnotherWay(t *testing.T) {
+	router := newRouter(0, 0)
+	dev, _ := newTestTunnel(t, "dev", "dev.example.com")
+	fallback, _ := newTestTunnel(t, "fallback", transport.DefaultUpstream)
+	router.add(dev)
+	router.add(fallback)
+
+	access, err := newAccessPolicies(map[string]*accessPolicy{
+		"dev.example.com": {BearerTokens: []string{"secret"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("access policies: %s", err)
+	}
+
+	// Every form of the host is routed to its own client and held to its
+	// policy, rather than falling through to the default client
+	for _, host := range []string{"dev.example.com", "dev.example.com.", "DEV.example.com.:8080"} {
+		t.Run(host, func(t *testing.T) {
+			if got := router.lookup(host); got != dev {
+				t.Fatalf("want the dev client, got %v", got)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = host
+
+			w := httptest.NewRecorder()
+			if access.check(w, r) || w.Code != http.StatusUnauthorized {
+				t.Fatalf("want the request refused with %d, got %d", http.StatusUnauthorized, w.Code)
+			}
+
+			r.Header.Set("Authorization", "Bearer secret")
+			if !access.check(httptest.NewRecorder(), r) {
+				t.Fatalf("want the request let through with the token")
+			}
+		})
+	}
+}
+
+func TestRouterWait(t *testing.T) {
+	tests := []struct {
+		name        string
+		waitTimeout time.Duration
+		arrives     string
+		cancel      bool
+		found       bool
+		err         error
+	}{
+		{"no wait", 0, "", false, false, errNoClient},
+		{"timed out", 100 * time.Millisecond, "", false, false, errNoClient},
+		{"client for another host", 100 * time.Millisecond, "other.example.com", false, false, errNoClient},
+		{"client arrives", 5 * time.Second, "app.example.com", false, true, nil},
+		{"default client arrives", 5 * time.Second, transport.DefaultUpstream, false, true, nil},
+		{"request cancelled", 5 * time.Second, "", true, false, context.Canceled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := newRouter(test.waitTimeout, 10)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var arrived *tunnel
+			if len(test.arrives) > 0 {
+				arrived, _ = newTestTunnel(t, "arrived", test.arrives)
+			}
+			time.AfterFunc(20*time.Millisecond, func() {
+				if arrived != nil {
+					router.add(arrived)
+				}
+				if test.cancel {
+					cancel()
+				}
+			})
+
+			start := time.Now()
+			got, err := router.wait(ctx, "app.example.com")
+			if err != test.err {
+				t.Fatalf("want error %v, got %v", test.err, err)
+			}
+			if found := got != nil && got == arrived; found != test.found {
+				t.Fatalf("want the client found %t, got %v", test.found, got)
+			}
+			if test.err == errNoClient && time.Since(start) < test.waitTimeout {
+				t.Fatalf("want a wait of %s, gave up after %s", test.waitTimeout, time.Since(start))
+			}
+		})
+	}
+}
+
+func TestRouterWaitLimit(t *testing.T) {
+	router := newRouter(5*time.Second, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan error, 1)
+	go func() {
+		_, err := router.wait(ctx, "app.example.com")
+		waited <- err
+	}()
+
+	// Only the first request is let wait
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		router.lock.RLock()
+		waiting := router.waiting
+		router.lock.RUnlock()
+
+		if waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the first request did not wait")
+		}
+	}
+
+	if _, err := router.wait(context.Background(), "app.example.com"); err != errTooManyWaiting {
+		t.Fatalf("want error %v, got %v", errTooManyWaiting, err)
+	}
+
+	cancel()
+	if err := <-waited; err != context.Canceled {
+		t.Fatalf("want error %v, got %v", context.Canceled, err)
+	}
+
+	router.lock.RLock()
+	defer router.lock.RUnlock()
+	if router.waiting != 0 {
+		t.Fatalf("want no requests waiting, got %d", router.waiting)
+	}
+}
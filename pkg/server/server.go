@@ -2,14 +2,19 @@ package server
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/alexellis/inlets/pkg/logger"
+	"github.com/alexellis/inlets/pkg/tracing"
 	"github.com/alexellis/inlets/pkg/transport"
 	"github.com/gorilla/websocket"
 	"github.com/twinj/uuid"
@@ -20,77 +25,497 @@ type Server struct {
 	GatewayTimeout time.Duration
 	Port           int
 	Token          string
+
+	// TokenFile is a JSON file or directory of per-client tokens, it is
+	// read again on SIGHUP
+	TokenFile string
+
+	// TokenSecret verifies signed tokens which carry the client's name,
+	// hosts and expiry
+	TokenSecret string
+
+	// MaxAuthFailures is how many times an IP may fail to authenticate
+	// before it is banned for AuthBanDuration
+	MaxAuthFailures int
+	AuthBanDuration time.Duration
+
+	// AdminPort serves metrics and, with an AdminToken, the admin API when
+	// set
+	AdminPort  int
+	AdminToken string
+
+	// AccessFile is a JSON file of the access policy for each public host
+	AccessFile string
+
+	// OIDCIssuer is the OpenID Connect provider which users of hosts with
+	// an "oidc" access policy log in with
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+
+	// OIDCCookieSecret signs login sessions so that they outlive restarts
+	OIDCCookieSecret string
+
+	// UDPIdleTimeout is how long a UDP session is kept without traffic
+	UDPIdleTimeout time.Duration
+
+	// PingInterval is how often clients are pinged, and PongTimeout how
+	// long to wait after that before a silent client is disconnected
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// ClientWaitTimeout is how long requests for a host with no connected
+	// client wait for one, they fail straight away when it is not set
+	ClientWaitTimeout time.Duration
+
+	// MaxWaitingRequests limits how many requests wait for a client at once
+	MaxWaitingRequests int
+
+	// DrainTimeout is how long requests in flight are given to finish when
+	// shutting down on SIGTERM or SIGINT
+	DrainTimeout time.Duration
+
+	// Hosts overrides settings for public hosts, which may be wildcards
+	Hosts map[string]HostOptions
+
+	// TLSPort serves HTTPS when TLS is enabled through TLSCertFile or ACME
+	TLSPort int
+
+	// TLSCertFile and TLSKeyFile hold a certificate for the TLS port
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ACME obtains certificates for the hostnames registered by clients
+	ACME bool
+
+	// ACMEEmail is given to the ACME server as the account contact
+	ACMEEmail string
+
+	// ACMEDirectory is the ACME server, Let's Encrypt production when empty
+	ACMEDirectory string
+
+	// ACMECAFile verifies an ACME server signed by a private CA
+	ACMECAFile string
+
+	// ACMECacheDir stores certificates and the account key between restarts
+	ACMECacheDir string
+
+	// ACMEDomains are the exit-node's own hostnames, such as the one clients
+	// connect to, which get certificates without a client registering them
+	ACMEDomains []string
+
+	// ClientCAFile requires tunnel clients to present a certificate signed
+	// by one of its CAs, the certificate's names scope the hosts served
+	ClientCAFile string
+
+	// ClientCRLFile lists revoked client certificates
+	ClientCRLFile string
+
+	// AccessLog logs a line for each proxied request
+	AccessLog bool
+
+	// TraceEndpoint is an OTLP/HTTP collector to export spans to
+	TraceEndpoint string
 }
 
 // Serve traffic
 func (s *Server) Serve() {
-	ch := make(chan *http.Response)
-	outgoing := make(chan *http.Request)
+	router := newRouter(s.ClientWaitTimeout, s.MaxWaitingRequests)
+	ports := newPortListeners(router, s.UDPIdleTimeout)
+
+	var oidc *oidcProvider
+	if len(s.OIDCIssuer) > 0 {
+		provider, err := s.newOIDCProvider()
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		oidc = provider
+	}
 
-	http.HandleFunc("/", proxyHandler(ch, outgoing, s.GatewayTimeout))
-	http.HandleFunc("/tunnel", serveWs(ch, outgoing, s.Token))
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", s.Port), nil); err != nil {
-		log.Fatal(err)
+	fromFile := map[string]*accessPolicy{}
+	if len(s.AccessFile) > 0 {
+		hosts, err := readAccessFile(s.AccessFile)
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		fromFile = hosts
+	}
+
+	hostPolicies, err := mergeAccessPolicies(fromFile, s.Hosts)
+	if err != nil {
+		logger.Fatalf("%s", err)
 	}
+
+	var access *accessPolicies
+	if len(hostPolicies) > 0 {
+		policies, err := newAccessPolicies(hostPolicies, oidc)
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		access = policies
+	}
+
+	options, err := newHostOptions(s.Hosts, s.GatewayTimeout)
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+
+	requests := newActiveRequests()
+
+	var tracer *tracing.Tracer
+	if len(s.TraceEndpoint) > 0 {
+		tracer = tracing.NewTracer(s.TraceEndpoint, "inlets-server")
+		logger.Infof("Exporting traces to %s", s.TraceEndpoint)
+	}
+
+	http.HandleFunc("/", instrument(router, s.AccessLog, proxyHandler(router, access, requests, tracer, options)))
+
+	auth, err := s.newAuthenticator()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+
+	if auth.tokens != nil {
+		logger.Infof("Loaded %d tokens from %s", auth.tokens.count(), s.TokenFile)
+
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				auth.reload()
+			}
+		}()
+	}
+
+	http.HandleFunc("/tunnel", serveWs(router, ports, auth, s.PingInterval, s.PongTimeout))
+
+	if s.AdminPort > 0 {
+		go s.serveAdmin(router, requests)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	servers := []*http.Server{}
+
+	if !s.tlsEnabled() {
+		httpServer := &http.Server{Addr: fmt.Sprintf(":%d", s.Port)}
+		servers = append(servers, httpServer)
+
+		go func() {
+			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatalf("%s", err)
+			}
+		}()
+	} else {
+		tlsConfig, httpHandler, err := s.tlsConfig(router, http.DefaultServeMux)
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+
+		httpServer := &http.Server{
+			Addr:    fmt.Sprintf(":%d", s.Port),
+			Handler: httpHandler,
+		}
+		tlsServer := &http.Server{
+			Addr:      fmt.Sprintf(":%d", s.TLSPort),
+			TLSConfig: tlsConfig,
+		}
+		servers = append(servers, httpServer, tlsServer)
+
+		go func() {
+			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatalf("%s", err)
+			}
+		}()
+
+		logger.Infof("Serving TLS on port %d", s.TLSPort)
+
+		go func() {
+			if err := tlsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				logger.Fatalf("%s", err)
+			}
+		}()
+	}
+
+	sig := <-stop
+	s.shutdown(sig, stop, servers, ports, router, requests, tracer)
+}
+
+// flushTimeout bounds exporting the remaining spans on shutdown, which
+// happens once the drain is over and its time used up
+const flushTimeout = 5 * time.Second
+
+// shutdown stops accepting requests and clients, then gives requests in
+// flight up to DrainTimeout to finish before disconnecting every client.
+// Another signal exits straight away.
+func (s *Server) shutdown(sig os.Signal, stop chan os.Signal, servers []*http.Server, ports *portListeners, router *router, requests *activeRequests, tracer *tracing.Tracer) {
+	logger.Infof("Received %s, draining %d requests for up to %s", sig, len(requests.list()), s.DrainTimeout)
+
+	go func() {
+		<-stop
+		logger.Warnf("Received a second signal, exiting without draining")
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+	defer cancel()
+
+	// Connections which have been upgraded, including the tunnels
+	// themselves, are not waited on by Shutdown
+	for _, server := range servers {
+		server.SetKeepAlivesEnabled(false)
+	}
+
+	// Forwarded ports stop accepting too, connections already forwarded end
+	// with their tunnel
+	ports.close()
+
+	// Every server is shut down even once the drain has timed out, so that
+	// each stops listening and closes its idle connections
+	timedOut := false
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err == context.DeadlineExceeded {
+			timedOut = true
+		} else if err != nil {
+			logger.Warnf("unable to shut down %s: %s", server.Addr, err)
+		}
+	}
+	if timedOut {
+		logger.Warnf("%d requests were still in flight after %s", len(requests.list()), s.DrainTimeout)
+	}
+
+	for _, t := range router.list() {
+		t.session.Close()
+	}
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancelFlush()
+
+	if err := tracer.Flush(flushCtx); err != nil {
+		logger.Warnf("unable to export the remaining spans: %s", err)
+	}
+
+	logger.Infof("Shut down")
 }
 
-func proxyHandler(msg chan *http.Response, outgoing chan *http.Request, gatewayTimeout time.Duration) func(w http.ResponseWriter, r *http.Request) {
+func proxyHandler(router *router, access *accessPolicies, requests *activeRequests, tracer *tracing.Tracer, options *hostOptions) func(w http.ResponseWriter, r *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		inletsID := uuid.Formatter(uuid.NewV4(), uuid.FormatHex)
+		inletsID := r.Header.Get(transport.InletsHeader)
+
+		logger.ID(inletsID).Debugf("proxy %s %s %s", r.Host, r.Method, r.URL.String())
 
-		log.Printf("[%s] proxy %s %s %s", inletsID, r.Host, r.Method, r.URL.String())
-		r.Header.Set(transport.InletsHeader, inletsID)
+		span := tracer.Start("proxy "+r.Method, tracing.KindServer, tracing.Extract(r.Header))
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("server.address", r.Host)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("client.address", remoteIP(r.RemoteAddr))
+		span.SetAttribute("inlets.id", inletsID)
+		defer span.End()
+
+		// The user header is only ever set by the exit-node, whether or not
+		// the host requires a login
+		r.Header.Del(transport.UserHeader)
+
+		if !access.check(w, r) {
+			logger.ID(inletsID).Warnf("access denied to %s for %s", r.Host, r.RemoteAddr)
+			return
+		}
+
+		t, err := router.wait(r.Context(), r.Host)
+		if err == errTooManyWaiting {
+			logger.ID(inletsID).Warnf("too many requests waiting for a client for host %s", r.Host)
+			span.SetAttribute("http.response.status_code", http.StatusServiceUnavailable)
+			span.SetError(err.Error())
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(fmt.Sprintf("Too many requests are waiting for a tunnel client for host: %s", r.Host)))
+			return
+		}
+		if err != nil {
+			logger.ID(inletsID).Warnf("no client connected for host %s", r.Host)
+			span.SetAttribute("http.response.status_code", http.StatusBadGateway)
+			span.SetError("no client connected")
+
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(fmt.Sprintf("No tunnel client is connected for host: %s", r.Host)))
+			return
+		}
+
+		span.SetAttribute("inlets.client_id", t.id)
+		if len(t.name) > 0 {
+			span.SetAttribute("inlets.client", t.name)
+		}
+
+		requests.add(&activeRequest{
+			ID:       inletsID,
+			ClientID: t.id,
+			Host:     r.Host,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Started:  time.Now(),
+		})
+		defer requests.remove(inletsID)
 
 		if r.Body != nil {
 			defer r.Body.Close()
 		}
 
-		body, _ := ioutil.ReadAll(r.Body)
-		// fmt.Println("RequestURI/Host", r.RequestURI, r.Host)
 		qs := ""
 		if len(r.URL.RawQuery) > 0 {
 			qs = "?" + r.URL.RawQuery
 		}
 
-		req, _ := http.NewRequest(r.Method, fmt.Sprintf("http://%s%s%s", r.Host, r.URL.Path, qs),
-			bytes.NewReader(body))
+		req, _ := http.NewRequest(r.Method, fmt.Sprintf("http://%s%s%s", r.Host, r.URL.Path, qs), r.Body)
+		req.ContentLength = r.ContentLength
 
 		transport.CopyHeaders(req.Header, &r.Header)
 
-		outgoing <- req
+		hostOptions := options.lookup(r.Host)
+		if hostOptions != nil {
+			setHeaders(req.Header, hostOptions.RequestHeaders)
+		}
 
-		log.Printf("[%s] waiting for response", inletsID)
+		// The client's spans are children of this one
+		span.Inject(req.Header)
 
-		cancel := make(chan bool)
+		stream, err := t.session.Open(inletsID, transport.TargetHTTP)
+		if err != nil {
+			logger.ID(inletsID).Errorf("unable to open stream: %s", err)
+			span.SetAttribute("http.response.status_code", http.StatusBadGateway)
+			span.SetError(err.Error())
 
-		timeout := time.AfterFunc(gatewayTimeout, func() {
-			cancel <- true
-		})
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(fmt.Sprintf("The tunnel client for host %s disconnected", r.Host)))
+			return
+		}
 
-		select {
-		case res := <-msg:
-			timeout.Stop()
+		// The request body is streamed to the client while waiting for the
+		// response, which may arrive before the body has been sent.
+		upgrade := transport.IsUpgrade(r.Header)
 
-			innerBody, _ := ioutil.ReadAll(res.Body)
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			if err := transport.WriteRequest(stream, req); err != nil {
+				logger.ID(inletsID).Errorf("unable to write request: %s", err)
+				stream.Reset()
+				return
+			}
 
-			transport.CopyHeaders(w.Header(), &res.Header)
-			w.WriteHeader(res.StatusCode)
-			w.Write(innerBody)
-			log.Printf("[%s] wrote %d bytes", inletsID, len(innerBody))
+			// An upgraded connection keeps writing to the stream
+			if !upgrade {
+				stream.Close()
+			}
+		}()
+
+		// The stream is reset unless the response was read to the end, the
+		// client's close may arrive after that and is not waited for
+		complete := false
+		defer func() {
+			if !complete {
+				stream.Reset()
+			}
+			<-written
+		}()
+
+		logger.ID(inletsID).Debugf("waiting for response")
+
+		// The gateway timeout starts once the request has been sent, so an
+		// upload may take as long as it needs
+		gatewayTimeout := options.timeout(r.Host)
+
+		var timeoutLock sync.Mutex
+		var timeout *time.Timer
+		responded := false
+		go func() {
+			<-written
+
+			timeoutLock.Lock()
+			defer timeoutLock.Unlock()
+			if !responded {
+				timeout = time.AfterFunc(gatewayTimeout, func() {
+					stream.Reset()
+				})
+			}
+		}()
 
-			break
-		case <-cancel:
-			log.Printf("[%s] timeout after %f secs\n", inletsID, gatewayTimeout.Seconds())
+		br := bufio.NewReader(stream)
+		res, err := http.ReadResponse(br, req)
+
+		timeoutLock.Lock()
+		responded = true
+		timedOut := timeout != nil && !timeout.Stop()
+		timeoutLock.Unlock()
+
+		if timedOut {
+			logger.ID(inletsID).Warnf("timeout after %f secs", gatewayTimeout.Seconds())
+			span.SetAttribute("http.response.status_code", http.StatusGatewayTimeout)
+			span.SetError("gateway timeout")
+			gatewayTimeouts.Inc(hostLabel(router, r.Host))
 
 			w.WriteHeader(http.StatusGatewayTimeout)
-			break
+			return
+		}
+
+		if err != nil {
+			logger.ID(inletsID).Errorf("unable to read response: %s", err)
+			span.SetAttribute("http.response.status_code", http.StatusBadGateway)
+			span.SetError(err.Error())
+
+			// The session fails every stream as soon as the client's
+			// connection drops, so callers don't wait for the timeout
+			w.WriteHeader(http.StatusBadGateway)
+			if !t.alive() {
+				w.Write([]byte(fmt.Sprintf("The tunnel client for host %s disconnected", r.Host)))
+			}
+			return
+		}
+
+		defer res.Body.Close()
+
+		span.SetAttribute("http.response.status_code", res.StatusCode)
+		if res.StatusCode >= http.StatusInternalServerError {
+			span.SetError(res.Status)
 		}
+
+		if upgrade && res.StatusCode == http.StatusSwitchingProtocols {
+			logger.ID(inletsID).Debugf("upgraded to %s", res.Header.Get("Upgrade"))
+
+			if err := upgradeConnection(w, res, transport.ReadWriteCloser{Reader: br, Writer: stream, Closer: stream}); err != nil {
+				logger.ID(inletsID).Errorf("unable to upgrade connection: %s", err)
+				span.SetError(err.Error())
+				return
+			}
+
+			logger.ID(inletsID).Debugf("upgraded connection closed")
+			return
+		}
+
+		transport.CopyHeaders(w.Header(), &res.Header)
+		if hostOptions != nil {
+			setHeaders(w.Header(), hostOptions.ResponseHeaders)
+		}
+		w.WriteHeader(res.StatusCode)
+
+		// The gateway timeout only applies until the headers arrive, a
+		// streaming response may then stay idle for as long as it likes.
+		n, err := copyResponse(w, res.Body)
+		if err != nil {
+			logger.ID(inletsID).Warnf("response interrupted after %d bytes: %s", n, err)
+			span.SetError(err.Error())
+			return
+		}
+
+		complete = true
+		logger.ID(inletsID).Debugf("wrote %d bytes", n)
 	}
 }
 
-func serveWs(msg chan *http.Response, outgoing chan *http.Request, token string) func(w http.ResponseWriter, r *http.Request) {
+func serveWs(router *router, ports *portListeners, auth *authenticator, pingInterval, pongTimeout time.Duration) func(w http.ResponseWriter, r *http.Request) {
 
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
@@ -99,74 +524,133 @@ func serveWs(msg chan *http.Response, outgoing chan *http.Request, token string)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		auth := r.Header.Get("Authorization")
-		valid := false
-		if len(token) == 0 {
-			valid = true
-		} else {
-			prefix := "Bearer "
-			if strings.HasPrefix(auth, prefix); len(auth) > len(prefix) && auth[len(prefix):] == token {
-				valid = true
-			}
+		id, status, err := auth.authenticate(r)
+		if err != nil {
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+			return
 		}
 
-		if !valid {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(`Send token in header Authorization: Bearer <token>`))
-			return
+		hosts := parseHosts(r.Header)
+		for _, host := range hosts {
+			if !id.allows(host) {
+				logger.Warnf("client %s (%s) is not allowed to serve host: %s", id.name, r.RemoteAddr, host)
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(fmt.Sprintf("Not allowed to serve host: %s", host)))
+				return
+			}
 		}
 
 		ws, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			if _, ok := err.(websocket.HandshakeError); !ok {
-				log.Println(err)
+				logger.Errorf("%s", err)
 			}
 			return
 		}
 
-		log.Printf("Connecting websocket on %s:", ws.RemoteAddr())
+		defer ws.Close()
+
+		logger.Infof("Connecting websocket on %s:", ws.RemoteAddr())
+
+		session := transport.NewSession(ws)
+		session.Heartbeat(pingInterval, pongTimeout)
+
+		t := &tunnel{
+			id:          uuid.Formatter(uuid.NewV4(), uuid.FormatHex),
+			remoteAddr:  ws.RemoteAddr().String(),
+			name:        id.name,
+			hosts:       hosts,
+			session:     session,
+			connectedAt: time.Now(),
+		}
+
+		router.add(t)
+		ports.open(t.hosts)
 
-		connectionDone := make(chan struct{})
+		connectedClients.Inc()
+		clientConnections.Inc()
+
+		defer func() {
+			connectedClients.Dec()
+			router.remove(t)
+			ports.release(t.hosts)
+		}()
+
+		if len(t.name) > 0 {
+			logger.ID(t.id).Infof("client %s authenticated as %s", t.remoteAddr, t.name)
+		}
+		logger.ID(t.id).Infof("client %s serving hosts: %s", t.remoteAddr, strings.Join(t.hosts, ", "))
 
 		go func() {
-			defer close(connectionDone)
-			for {
-				msgType, message, err := ws.ReadMessage()
-				if err != nil {
-					log.Println("read:", err)
-					return
-				}
-
-				if msgType == websocket.TextMessage {
-					log.Println("TextMessage: ", message)
-				} else if msgType == websocket.BinaryMessage {
-					// log.Printf("Server recv: %s", message)
-
-					reader := bytes.NewReader(message)
-					scanner := bufio.NewReader(reader)
-					res, _ := http.ReadResponse(scanner, nil)
-
-					msg <- res
-				}
+			select {
+			case <-session.GoingAway():
+				logger.ID(t.id).Infof("client %s is going away, no longer routing requests to it", t.remoteAddr)
+			case <-session.Done():
 			}
 		}()
 
-		go func() {
-			defer close(connectionDone)
-			for {
-				log.Printf("wait for request")
-				outboundRequest := <-outgoing
-				log.Printf("[%s] request written to websocket", outboundRequest.Header.Get(transport.InletsHeader))
+		err = session.Serve()
+		if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+			logger.ID(t.id).Infof("client %s shut down cleanly", t.remoteAddr)
+		} else if err != nil && err != transport.ErrSessionClosed {
+			logger.Errorf("read: %s", err)
+		}
+
+		logger.ID(t.id).Infof("client %s disconnected", t.remoteAddr)
+	}
+}
+
+// upgradeConnection takes over the caller's connection once the upstream
+// has switched protocols, then relays it through the tunnel until either
+// side closes
+func upgradeConnection(w http.ResponseWriter, res *http.Response, tunnel io.ReadWriteCloser) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("connection does not support hijacking")
+	}
 
-				buf := new(bytes.Buffer)
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+
+	if err := res.Write(conn); err != nil {
+		conn.Close()
+		return err
+	}
+
+	transport.Pipe(transport.ReadWriteCloser{Reader: bufrw, Writer: conn, Closer: conn}, tunnel)
+	return nil
+}
+
+// copyResponse copies body to w, flushing after every read so that
+// Server-Sent Events and other streamed responses reach the caller as the
+// upstream produces them
+func copyResponse(w http.ResponseWriter, body io.Reader) (int64, error) {
+	flusher, _ := w.(http.Flusher)
 
-				outboundRequest.Write(buf)
+	buf := make([]byte, transport.MaxFramePayload)
+	var written int64
 
-				ws.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return written, err
 			}
+			written += int64(n)
 
-		}()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
 
-		<-connectionDone
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
 	}
 }
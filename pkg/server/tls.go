@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsEnabled reports whether the exit-node terminates TLS itself
+func (s *Server) tlsEnabled() bool {
+	return s.ACME || len(s.TLSCertFile) > 0
+}
+
+// tlsConfig builds the configuration for the TLS port along with the
+// handler for the plain HTTP port, which also answers ACME HTTP-01
+// challenges when certificates are obtained automatically
+func (s *Server) tlsConfig(router *router, handler http.Handler) (*tls.Config, http.Handler, error) {
+	config, handler, err := s.serverCertificates(router, handler)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Client certificates are optional during the handshake as the same
+	// port serves public traffic, serveWs requires them for /tunnel.
+	if len(s.ClientCAFile) > 0 {
+		cas, err := readCertificates(s.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pool := x509.NewCertPool()
+		for _, ca := range cas {
+			pool.AddCert(ca)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, handler, nil
+}
+
+func (s *Server) serverCertificates(router *router, handler http.Handler) (*tls.Config, http.Handler, error) {
+	if !s.ACME {
+		cert, err := tls.LoadX509KeyPair(s.TLSCertFile, s.TLSKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to load TLS certificate: %s", err)
+		}
+
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, handler, nil
+	}
+
+	client, err := s.acmeClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manager := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(s.ACMECacheDir),
+		Email:  s.ACMEEmail,
+		Client: client,
+
+		HostPolicy: acmeHostPolicy(router, s.ACMEDomains),
+	}
+
+	return manager.TLSConfig(), manager.HTTPHandler(handler), nil
+}
+
+// acmeHostPolicy only allows certificates for the exit-node's own domains
+// and hostnames which a client has registered, so the exit-node can't be
+// used to request them for arbitrary names
+func acmeHostPolicy(router *router, domains []string) autocert.HostPolicy {
+	own := map[string]bool{}
+	for _, domain := range domains {
+		own[normalizeHost(domain)] = true
+	}
+
+	return func(ctx context.Context, host string) error {
+		host = normalizeHost(host)
+		if own[host] || router.get(host) != nil {
+			return nil
+		}
+		return fmt.Errorf("no client is connected for host: %s", host)
+	}
+}
+
+func (s *Server) acmeClient() (*acme.Client, error) {
+	directory := s.ACMEDirectory
+	if len(directory) == 0 {
+		directory = autocert.DefaultACMEDirectory
+	}
+
+	client := &acme.Client{DirectoryURL: directory}
+
+	// A private ACME server such as Pebble or step-ca is usually signed by
+	// its own CA.
+	if len(s.ACMECAFile) > 0 {
+		pem, err := ioutil.ReadFile(s.ACMECAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ACME CA file: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ACME CA file: %s", s.ACMECAFile)
+		}
+
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	return client, nil
+}
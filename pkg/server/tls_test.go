@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/transport"
+)
+
+// testCert is a certificate and its key, signed by parent or self-signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %s", err)
+	}
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves the certificate and key as PEM files and returns their paths
+func (c *testCert) write(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("marshal key: %s", err)
+	}
+
+	certFile := filepath.Join(dir, c.cert.Subject.CommonName+".crt")
+	keyFile := filepath.Join(dir, c.cert.Subject.CommonName+".key")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	return certFile, keyFile
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func writeFile(t *testing.T, file string, data []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("write %s: %s", file, err)
+	}
+}
+
+func TestACMEHostPolicy(t *testing.T) {
+	router := newRouter(0, 0)
+	router.add(&tunnel{id: "1", hosts: []string{"app.example.com"}})
+
+	policy := acmeHostPolicy(router, []string{"Tunnel.Example.com"})
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"tunnel.example.com", true},
+		{"TUNNEL.example.com", true},
+		{"app.example.com", true},
+		{"other.example.com", false},
+		{"example.com", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			err := policy(context.Background(), test.host)
+			if test.allowed && err != nil {
+				t.Fatalf("want %s allowed, got %s", test.host, err)
+			}
+			if !test.allowed && err == nil {
+				t.Fatalf("want %s rejected", test.host)
+			}
+		})
+	}
+}
+
+func TestTLSConfigACME(t *testing.T) {
+	s := &Server{ACME: true, ACMECacheDir: t.TempDir()}
+	router := newRouter(0, 0)
+	router.add(&tunnel{id: "1", hosts: []string{"app.example.com"}})
+
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	config, handler, err := s.tlsConfig(router, fallback)
+	if err != nil {
+		t.Fatalf("tls config: %s", err)
+	}
+	if config.GetCertificate == nil {
+		t.Fatalf("want certificates from the ACME manager")
+	}
+
+	found := false
+	for _, proto := range config.NextProtos {
+		found = found || proto == "acme-tls/1"
+	}
+	if !found {
+		t.Fatalf("want TLS-ALPN-01 challenges accepted, got protocols %v", config.NextProtos)
+	}
+
+	// Challenges are answered by the manager for allowed hosts only,
+	// anything else is passed on
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"http://app.example.com/.well-known/acme-challenge/unknown", http.StatusNotFound},
+		{"http://other.example.com/.well-known/acme-challenge/unknown", http.StatusForbidden},
+		{"http://app.example.com/", http.StatusTeapot},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.url, nil))
+		if w.Code != test.want {
+			t.Errorf("%s: want %d, got %d", test.url, test.want, w.Code)
+		}
+	}
+}
+
+func TestACMEClient(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "acme-ca", nil)
+	caFile, _ := ca.write(t, dir)
+	emptyFile := filepath.Join(dir, "empty.pem")
+	writeFile(t, emptyFile, []byte("no certificates here\n"))
+
+	client, err := (&Server{}).acmeClient()
+	if err != nil {
+		t.Fatalf("acme client: %s", err)
+	}
+	if !strings.Contains(client.DirectoryURL, "letsencrypt.org") || client.HTTPClient != nil {
+		t.Fatalf("want Let's Encrypt with the default HTTP client, got %s", client.DirectoryURL)
+	}
+
+	client, err = (&Server{ACMEDirectory: "https://localhost:14000/dir", ACMECAFile: caFile}).acmeClient()
+	if err != nil {
+		t.Fatalf("acme client: %s", err)
+	}
+	if client.DirectoryURL != "https://localhost:14000/dir" {
+		t.Fatalf("want the given directory, got %s", client.DirectoryURL)
+	}
+	if client.HTTPClient == nil || client.HTTPClient.Transport.(*http.Transport).TLSClientConfig.RootCAs == nil {
+		t.Fatalf("want the ACME server verified with the given CA")
+	}
+
+	for _, file := range []string{emptyFile, filepath.Join(dir, "missing.pem")} {
+		if _, err := (&Server{ACMECAFile: file}).acmeClient(); err == nil {
+			t.Errorf("want an error for ACME CA file %s", file)
+		}
+	}
+}
+
+func TestTLSConfigCertificateErrors(t *testing.T) {
+	dir := t.TempDir()
+	cert := newTestCert(t, "tunnel.example.com", nil)
+	certFile, keyFile := cert.write(t, dir)
+	emptyFile := filepath.Join(dir, "empty.pem")
+	writeFile(t, emptyFile, []byte("no certificates here\n"))
+
+	tests := []struct {
+		name   string
+		server *Server
+	}{
+		{"missing certificate", &Server{TLSCertFile: filepath.Join(dir, "missing.crt"), TLSKeyFile: keyFile}},
+		{"key given as certificate", &Server{TLSCertFile: keyFile, TLSKeyFile: keyFile}},
+		{"missing client CA", &Server{TLSCertFile: certFile, TLSKeyFile: keyFile, ClientCAFile: filepath.Join(dir, "missing.pem")}},
+		{"client CA without certificates", &Server{TLSCertFile: certFile, TLSKeyFile: keyFile, ClientCAFile: emptyFile}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := test.server.tlsConfig(newRouter(0, 0), http.NotFoundHandler()); err == nil {
+				t.Fatalf("want an error")
+			}
+		})
+	}
+}
+
+func TestTLSConfigClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "client-ca", nil)
+	caFile, _ := ca.write(t, dir)
+	certFile, keyFile := newTestCert(t, "tunnel.example.com", ca).write(t, dir)
+
+	s := &Server{TLSCertFile: certFile, TLSKeyFile: keyFile, ClientCAFile: caFile}
+	config, _, err := s.tlsConfig(newRouter(0, 0), http.NotFoundHandler())
+	if err != nil {
+		t.Fatalf("tls config: %s", err)
+	}
+	if config.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatalf("want client certificates verified if given, got %s", config.ClientAuth)
+	}
+
+	// The handler reports the client's verified name, if any
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name    string
+		client  *testCert
+		want    string
+		refused bool
+	}{
+		{"without a certificate", nil, "", false},
+		{"signed by the client CA", newTestCert(t, "laptop", ca), "laptop", false},
+		{"signed by another CA", newTestCert(t, "intruder", newTestCert(t, "other-ca", nil)), "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientConfig := &tls.Config{RootCAs: roots, ServerName: "tunnel.example.com"}
+			if test.client != nil {
+				// Sent even when the server asks for another CA
+				cert := test.client.tls()
+				clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return &cert, nil
+				}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+
+			res, err := client.Get(server.URL)
+			if test.refused {
+				if err == nil {
+					res.Body.Close()
+					t.Fatalf("want the handshake refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("get: %s", err)
+			}
+			defer res.Body.Close()
+
+			body, _ := ioutil.ReadAll(res.Body)
+			if string(body) != test.want {
+				t.Fatalf("want verified name %q, got %q", test.want, body)
+			}
+		})
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	ca := newTestCert(t, "client-ca", nil)
+	cert := newTestCert(t, "laptop", ca).cert
+	cert.DNSNames = []string{"App.Example.com"}
+
+	id := certIdentity(cert)
+	if !id.allows("app.example.com") || id.allows("other.example.com") {
+		t.Fatalf("want the certificate scoped to its DNS names, got %v", id)
+	}
+	if id.allows(transport.TCPPrefix + "2222") {
+		t.Fatalf("want no ports without a URI naming them")
+	}
+}
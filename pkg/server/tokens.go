@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// storedToken is an entry in a token file
+type storedToken struct {
+	// Name identifies the client in logs
+	Name string `json:"name"`
+
+	// Token is the bearer token the client presents
+	Token string `json:"token"`
+
+	// Hosts the client may serve, see identity.allows
+	Hosts []string `json:"hosts"`
+
+	// Expires is when the token stops being accepted, it never expires when
+	// omitted
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// tokenStore holds per-client tokens read from a JSON file, or from every
+// .json file in a directory. Each file holds a list of tokens.
+type tokenStore struct {
+	path string
+
+	// tokens are keyed by the SHA-256 hash of the token so that looking one
+	// up does not leak how much of a guess matched through its timing
+	lock   sync.RWMutex
+	tokens map[[sha256.Size]byte]*storedToken
+}
+
+func newTokenStore(path string) (*tokenStore, error) {
+	store := &tokenStore{path: path}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// load replaces the tokens with the contents of path, the previous tokens
+// are kept if it can't be read
+func (t *tokenStore) load() error {
+	files := []string{t.path}
+
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return fmt.Errorf("unable to read token file: %s", err)
+	}
+
+	if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(t.path, "*.json"))
+		if err != nil {
+			return fmt.Errorf("unable to read token directory: %s", err)
+		}
+		sort.Strings(files)
+	}
+
+	tokens := make(map[[sha256.Size]byte]*storedToken)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("unable to read token file: %s", err)
+		}
+
+		entries := []*storedToken{}
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("unable to parse token file %s: %s", file, err)
+		}
+
+		for i, entry := range entries {
+			if len(entry.Name) == 0 || len(entry.Token) == 0 {
+				return fmt.Errorf("token %d in %s needs a name and a token", i, file)
+			}
+			key := sha256.Sum256([]byte(entry.Token))
+			if _, ok := tokens[key]; ok {
+				return fmt.Errorf("token for %s in %s is already in use", entry.Name, file)
+			}
+
+			for j, host := range entry.Hosts {
+				entry.Hosts[j] = normalizeHost(host)
+			}
+			tokens[key] = entry
+		}
+	}
+
+	t.lock.Lock()
+	t.tokens = tokens
+	t.lock.Unlock()
+
+	return nil
+}
+
+// lookup returns the identity for token
+func (t *tokenStore) lookup(token string) (*identity, error) {
+	t.lock.RLock()
+	entry, ok := t.tokens[sha256.Sum256([]byte(token))]
+	t.lock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown token")
+	}
+
+	if !entry.Expires.IsZero() && time.Now().After(entry.Expires) {
+		return nil, fmt.Errorf("token for %s expired at %s", entry.Name, entry.Expires.Format(time.RFC3339))
+	}
+
+	return &identity{name: entry.Name, scopes: [][]string{entry.Hosts}}, nil
+}
+
+// count returns how many tokens are loaded
+func (t *tokenStore) count() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return len(t.tokens)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenStoreLookup(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+	writeFile(t, file, []byte(fmt.Sprintf(`[
+  {"name": "laptop", "token": "current", "hosts": ["App.Example.com."]},
+  {"name": "ci", "token": "later", "hosts": ["ci.example.com"], "expires": %q},
+  {"name": "old", "token": "expired", "hosts": ["old.example.com"], "expires": %q}
+]`, time.Now().Add(time.Hour).Format(time.RFC3339), time.Now().Add(-time.Minute).Format(time.RFC3339))))
+
+	store, err := newTokenStore(file)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+
+	tests := []struct {
+		token string
+		name  string
+		host  string
+	}{
+		{"current", "laptop", "app.example.com"},
+		{"later", "ci", "ci.example.com"},
+		{"expired", "", ""},
+		{"unknown", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.token, func(t *testing.T) {
+			id, err := store.lookup(test.token)
+			if len(test.name) == 0 {
+				if err == nil {
+					t.Fatalf("want the token rejected, got %s", id.name)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("lookup: %s", err)
+			}
+			if id.name != test.name || !id.allows(test.host) {
+				t.Fatalf("want %s serving %s, got %s serving %v", test.name, test.host, id.name, id.scopes)
+			}
+		})
+	}
+}
+
+func TestTokenStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.json"), []byte(`[{"name": "laptop", "token": "first", "hosts": ["*"]}]`))
+
+	store, err := newTokenStore(dir)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+
+	writeFile(t, filepath.Join(dir, "a.json"), []byte(`[{"name": "laptop", "token": "rotated", "hosts": ["*"]}]`))
+	writeFile(t, filepath.Join(dir, "b.json"), []byte(`[{"name": "ci", "token": "added", "hosts": ["*"]}]`))
+
+	if err := store.load(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+
+	if _, err := store.lookup("first"); err == nil {
+		t.Fatalf("want the replaced token rejected after a reload")
+	}
+	for _, token := range []string{"rotated", "added"} {
+		if _, err := store.lookup(token); err != nil {
+			t.Fatalf("want %s accepted after a reload, got %s", token, err)
+		}
+	}
+
+	// A file which can't be parsed leaves the tokens as they were
+	writeFile(t, filepath.Join(dir, "b.json"), []byte(`[{"name": "ci",`))
+
+	if err := store.load(); err == nil {
+		t.Fatalf("want an error for a file which can't be parsed")
+	}
+	if store.count() != 2 {
+		t.Fatalf("want the 2 tokens kept, got %d", store.count())
+	}
+}
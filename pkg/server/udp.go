@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/logger"
+	"github.com/alexellis/inlets/pkg/transport"
+	"github.com/twinj/uuid"
+)
+
+// defaultUDPIdleTimeout is used when the server has no UDPIdleTimeout set
+const defaultUDPIdleTimeout = time.Minute
+
+// udpRelay forwards datagrams received on a port claimed through a udp:
+// upstream. Each source address gets a stream of its own, which is reset
+// once it has been idle for longer than idleTimeout.
+type udpRelay struct {
+	host        string
+	conn        net.PacketConn
+	router      *router
+	idleTimeout time.Duration
+	done        chan struct{}
+
+	lock     sync.Mutex
+	sessions map[string]*udpSession
+}
+
+type udpSession struct {
+	id         string
+	addr       net.Addr
+	stream     *transport.Stream
+	lastActive time.Time
+}
+
+func newUDPRelay(host string, conn net.PacketConn, router *router, idleTimeout time.Duration) *udpRelay {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+
+	return &udpRelay{
+		host:        host,
+		conn:        conn,
+		router:      router,
+		idleTimeout: idleTimeout,
+		done:        make(chan struct{}),
+		sessions:    make(map[string]*udpSession),
+	}
+}
+
+// Close stops listening and ends every session
+func (u *udpRelay) Close() error {
+	return u.conn.Close()
+}
+
+func (u *udpRelay) serve() {
+	go u.expire()
+
+	defer func() {
+		close(u.done)
+
+		u.lock.Lock()
+		sessions := u.sessions
+		u.sessions = make(map[string]*udpSession)
+		u.lock.Unlock()
+
+		for _, sess := range sessions {
+			sess.stream.Reset()
+		}
+	}()
+
+	buf := make([]byte, transport.MaxDatagramSize)
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		sess := u.session(addr)
+		if sess == nil {
+			continue
+		}
+
+		// Waiting for a slow client to grant more window would hold up
+		// every other source on the port
+		sent, err := transport.TryWriteDatagram(sess.stream, buf[:n])
+		if err != nil {
+			logger.ID(sess.id).Errorf("unable to relay datagram: %s", err)
+			u.remove(sess)
+			continue
+		}
+		if !sent {
+			logger.ID(sess.id).Debugf("dropping datagram from %s, the client has not caught up", addr)
+		}
+	}
+}
+
+// session finds or starts the session for datagrams from addr. The stream
+// is opened without holding the lock as it writes to the tunnel, only serve
+// starts sessions so no other can be added for addr meanwhile.
+func (u *udpRelay) session(addr net.Addr) *udpSession {
+	u.lock.Lock()
+	sess, ok := u.sessions[addr.String()]
+	if ok {
+		sess.lastActive = time.Now()
+	}
+	u.lock.Unlock()
+
+	if ok {
+		return sess
+	}
+
+	inletsID := uuid.Formatter(uuid.NewV4(), uuid.FormatHex)
+
+	t := u.router.get(u.host)
+	if t == nil {
+		logger.ID(inletsID).Warnf("no client connected for %s", u.host)
+		return nil
+	}
+
+	stream, err := t.session.Open(inletsID, u.host)
+	if err != nil {
+		logger.ID(inletsID).Errorf("unable to open stream: %s", err)
+		return nil
+	}
+
+	logger.ID(inletsID).Debugf("relaying %s from %s", u.host, addr)
+
+	sess = &udpSession{
+		id:         inletsID,
+		addr:       addr,
+		stream:     stream,
+		lastActive: time.Now(),
+	}
+
+	u.lock.Lock()
+	u.sessions[addr.String()] = sess
+	u.lock.Unlock()
+
+	go u.reply(sess)
+
+	return sess
+}
+
+// reply sends datagrams from the upstream back to the session's source
+func (u *udpRelay) reply(sess *udpSession) {
+	defer u.remove(sess)
+
+	br := bufio.NewReader(sess.stream)
+	for {
+		payload, err := transport.ReadDatagram(br)
+		if err != nil {
+			return
+		}
+
+		u.lock.Lock()
+		sess.lastActive = time.Now()
+		u.lock.Unlock()
+
+		if _, err := u.conn.WriteTo(payload, sess.addr); err != nil {
+			logger.ID(sess.id).Errorf("unable to reply to %s: %s", sess.addr, err)
+			return
+		}
+	}
+}
+
+// expire ends sessions which have been idle for longer than idleTimeout
+func (u *udpRelay) expire() {
+	ticker := time.NewTicker(u.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+		}
+
+		idle := []*udpSession{}
+
+		u.lock.Lock()
+		for _, sess := range u.sessions {
+			if time.Since(sess.lastActive) > u.idleTimeout {
+				idle = append(idle, sess)
+			}
+		}
+		u.lock.Unlock()
+
+		for _, sess := range idle {
+			logger.ID(sess.id).Debugf("session from %s idle for %s", sess.addr, u.idleTimeout)
+			u.remove(sess)
+		}
+	}
+}
+
+func (u *udpRelay) remove(sess *udpSession) {
+	u.lock.Lock()
+	if u.sessions[sess.addr.String()] == sess {
+		delete(u.sessions, sess.addr.String())
+	}
+	u.lock.Unlock()
+
+	sess.stream.Reset()
+}
@@ -0,0 +1,93 @@
+package token
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Unix(1700000000, 0)
+
+	issue := func(claims Claims) string {
+		token, err := Issue(secret, claims)
+		if err != nil {
+			t.Fatalf("issue: %s", err)
+		}
+		return token
+	}
+
+	valid := issue(Claims{Subject: "laptop", Hosts: []string{"app.example.com"}, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+	parts := strings.Split(valid, ".")
+
+	// Claims signed by another secret, or with their hosts widened after
+	// signing
+	forged, _ := Issue([]byte("guessed"), Claims{Subject: "laptop", Hosts: []string{"*"}, ExpiresAt: now.Add(time.Hour).Unix()})
+	widened := strings.Split(issue(Claims{Subject: "laptop", Hosts: []string{"*"}, ExpiresAt: now.Add(time.Hour).Unix()}), ".")[1]
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", valid, ""},
+		{"expired", issue(Claims{Subject: "laptop", ExpiresAt: now.Unix()}), "token for laptop expired at 2023-11-14T22:13:20Z"},
+		{"no expiry", issue(Claims{Subject: "laptop"}), "token for laptop has no expiry"},
+		{"other secret", forged, "invalid token signature"},
+		{"altered claims", parts[0] + "." + widened + "." + parts[2], "invalid token signature"},
+		{"no signature", parts[0] + "." + parts[1] + ".", "invalid token signature"},
+		{"algorithm none", encode([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", "invalid token signature"},
+		{"malformed signature", parts[0] + "." + parts[1] + ".!!", "malformed token signature"},
+		{"two parts", parts[0] + "." + parts[1], "malformed token"},
+		{"shared token", "7a5f0a8e2d", "malformed token"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := Verify(secret, test.token, now)
+			if len(test.err) > 0 {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("want error %q, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("verify: %s", err)
+			}
+			if claims.Subject != "laptop" || len(claims.Hosts) != 1 || claims.Hosts[0] != "app.example.com" {
+				t.Fatalf("unexpected claims: %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyRefusesOtherAlgorithms(t *testing.T) {
+	secret := []byte("secret")
+
+	// Correctly signed, but naming an algorithm other than HS256
+	signed := encode([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + encode([]byte(`{"sub":"laptop","exp":4102444800}`))
+	token := signed + "." + encode(sign(secret, signed))
+
+	if _, err := Verify(secret, token, time.Now()); err == nil || err.Error() != "unsupported token algorithm" {
+		t.Fatalf("want unsupported token algorithm, got %v", err)
+	}
+}
+
+func TestIsSigned(t *testing.T) {
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{"a.b.c", true},
+		{"7a5f0a8e2d", false},
+		{"a.b", false},
+	}
+
+	for _, test := range tests {
+		if got := IsSigned(test.token); got != test.want {
+			t.Errorf("%s: want %t, got %t", test.token, test.want, got)
+		}
+	}
+}
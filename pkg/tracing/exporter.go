@@ -0,0 +1,281 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/logger"
+)
+
+const (
+	queueSize     = 2048
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+)
+
+// exporter sends spans in batches to an OTLP/HTTP collector as JSON
+type exporter struct {
+	url     string
+	service string
+	client  *http.Client
+	queue   chan *Span
+	flushes chan chan struct{}
+}
+
+func newExporter(endpoint, service string) *exporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url = url + "/v1/traces"
+	}
+
+	e := &exporter{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan *Span, queueSize),
+		flushes: make(chan chan struct{}),
+	}
+	go e.run()
+
+	return e
+}
+
+// export queues a span, dropping it rather than slowing down the request
+// when the collector can't keep up
+func (e *exporter) export(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		logger.Debugf("dropping span %s, the export queue is full", s.name)
+	}
+}
+
+func (e *exporter) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	for {
+		var flushed chan struct{}
+
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case flushed = <-e.flushes:
+			batch = append(batch, e.drain()...)
+			if len(batch) == 0 {
+				close(flushed)
+				continue
+			}
+		}
+
+		if err := e.send(batch); err != nil {
+			logger.Warnf("unable to export %d spans: %s", len(batch), err)
+		}
+		batch = []*Span{}
+
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// drain takes every span which is queued
+func (e *exporter) drain() []*Span {
+	spans := []*Span{}
+	for {
+		select {
+		case s := <-e.queue:
+			spans = append(spans, s)
+		default:
+			return spans
+		}
+	}
+}
+
+// flush exports the queued spans, waiting until they have been sent or ctx
+// is done
+func (e *exporter) flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+
+	select {
+	case e.flushes <- flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *exporter) send(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s from %s: %s", res.Status, e.url, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// The OTLP JSON encoding, where ids are hex and 64 bit integers are strings
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []spanData `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type spanData struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            *status    `json:"status,omitempty"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// statusError is STATUS_CODE_ERROR
+const statusError = 2
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *exporter) request(spans []*Span) exportRequest {
+	data := make([]spanData, 0, len(spans))
+	for _, s := range spans {
+		data = append(data, s.data())
+	}
+
+	return exportRequest{
+		ResourceSpans: []resourceSpans{{
+			Resource: resource{
+				Attributes: []keyValue{attribute("service.name", e.service)},
+			},
+			ScopeSpans: []scopeSpans{{
+				Scope: scope{Name: "github.com/alexellis/inlets"},
+				Spans: data,
+			}},
+		}},
+	}
+}
+
+func (s *Span) data() spanData {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d := spanData{
+		TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+		Name:              s.name,
+		Kind:              int(s.kind),
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+
+	if s.parentID != [8]byte{} {
+		d.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+
+	keys := make([]string, 0, len(s.attributes))
+	for key := range s.attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		d.Attributes = append(d.Attributes, attribute(key, s.attributes[key]))
+	}
+
+	if len(s.err) > 0 {
+		d.Status = &status{Code: statusError, Message: s.err}
+	}
+	return d
+}
+
+func attribute(key string, value interface{}) keyValue {
+	v := anyValue{}
+
+	switch typed := value.(type) {
+	case string:
+		v.StringValue = &typed
+	case bool:
+		v.BoolValue = &typed
+	case int:
+		i := strconv.FormatInt(int64(typed), 10)
+		v.IntValue = &i
+	case int64:
+		i := strconv.FormatInt(typed, 10)
+		v.IntValue = &i
+	case float64:
+		v.DoubleValue = &typed
+	default:
+		str := fmt.Sprint(typed)
+		v.StringValue = &str
+	}
+
+	return keyValue{Key: key, Value: v}
+}
@@ -0,0 +1,216 @@
+// Package tracing records spans for requests through the tunnel and carries
+// their context between the exit-node, the client and the upstream in the
+// W3C traceparent header. Spans are exported over OTLP/HTTP.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader carries the trace context
+const TraceparentHeader = "traceparent"
+
+// SpanKind says which side of a call a span is on
+type SpanKind int
+
+// Span kinds as numbered by OTLP
+const (
+	KindServer SpanKind = 2
+	KindClient SpanKind = 3
+)
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether the trace and span ids are set
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+// Traceparent formats the context as a traceparent header value
+func (c SpanContext) Traceparent() string {
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(c.TraceID[:]), hex.EncodeToString(c.SpanID[:]), flags)
+}
+
+// ParseTraceparent reads a traceparent header value
+func ParseTraceparent(value string) (SpanContext, error) {
+	c := SpanContext{}
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return c, fmt.Errorf("invalid traceparent: %q", value)
+	}
+
+	// Version ff is forbidden and version 00 has exactly four parts
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return c, fmt.Errorf("invalid traceparent: %q", value)
+	}
+
+	if _, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+		return c, fmt.Errorf("invalid trace id: %q", parts[1])
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+		return c, fmt.Errorf("invalid span id: %q", parts[2])
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return c, fmt.Errorf("invalid trace flags: %q", parts[3])
+	}
+	c.Sampled = flags[0]&1 == 1
+
+	if !c.IsValid() {
+		return c, fmt.Errorf("invalid traceparent: %q", value)
+	}
+	return c, nil
+}
+
+// Extract reads the trace context from headers, it is not valid when the
+// headers have none
+func Extract(header http.Header) SpanContext {
+	c, err := ParseTraceparent(header.Get(TraceparentHeader))
+	if err != nil {
+		return SpanContext{}
+	}
+	return c
+}
+
+// Tracer starts spans and exports them, a nil tracer starts nil spans
+// which do nothing
+type Tracer struct {
+	exporter *exporter
+}
+
+// NewTracer exports spans for service to the OTLP/HTTP endpoint, such as
+// http://127.0.0.1:4318
+func NewTracer(endpoint, service string) *Tracer {
+	return &Tracer{exporter: newExporter(endpoint, service)}
+}
+
+// Flush exports the spans which have ended, for use before exiting
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.flush(ctx)
+}
+
+// Start starts a span, as a child of parent when it is valid or else in a
+// new trace
+func (t *Tracer) Start(name string, kind SpanKind, parent SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+
+	if parent.IsValid() {
+		s.context.TraceID = parent.TraceID
+		s.context.Sampled = parent.Sampled
+		s.parentID = parent.SpanID
+	} else {
+		rand.Read(s.context.TraceID[:])
+		s.context.Sampled = true
+	}
+	rand.Read(s.context.SpanID[:])
+
+	return s
+}
+
+// Span times one operation
+type Span struct {
+	tracer   *Tracer
+	name     string
+	kind     SpanKind
+	context  SpanContext
+	parentID [8]byte
+	start    time.Time
+
+	lock       sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+	ended      bool
+}
+
+// Context returns the span's context to propagate to children
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// Inject sets the traceparent header for the span, so the receiver's spans
+// are its children
+func (s *Span) Inject(header http.Header) {
+	if s == nil {
+		return
+	}
+	header.Set(TraceparentHeader, s.context.Traceparent())
+}
+
+// SetAttribute records a string, bool, int or float value on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.err = message
+}
+
+// End finishes the span and queues it for export when sampled
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.lock.Unlock()
+
+	if s.context.Sampled {
+		s.tracer.exporter.export(s)
+	}
+}
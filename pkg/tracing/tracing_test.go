@@ -0,0 +1,211 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		valid   bool
+		sampled bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"later version with more parts", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"version 00 with more parts", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"forbidden version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"short trace id", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false, false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", false, false},
+		{"empty", "", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := ParseTraceparent(test.value)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("want an error for %q", test.value)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+			if c.Sampled != test.sampled {
+				t.Fatalf("want sampled %t, got %t", test.sampled, c.Sampled)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	c, err := ParseTraceparent(value)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if got := c.Traceparent(); got != value {
+		t.Fatalf("want %s, got %s", value, got)
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	tracer := &Tracer{exporter: &exporter{queue: make(chan *Span, 8)}}
+
+	// A request without a trace context starts a new, sampled trace
+	root := tracer.Start("proxy GET", KindServer, Extract(http.Header{}))
+	if !root.Context().IsValid() || !root.Context().Sampled {
+		t.Fatalf("want a new sampled trace, got %+v", root.Context())
+	}
+
+	header := http.Header{}
+	root.Inject(header)
+
+	// The receiver's span is a child in the same trace
+	child := tracer.Start("upstream GET", KindClient, Extract(header))
+	if child.Context().TraceID != root.Context().TraceID {
+		t.Fatalf("want the trace id carried over")
+	}
+	if child.parentID != root.Context().SpanID || child.Context().SpanID == root.Context().SpanID {
+		t.Fatalf("want a new span with the sender as its parent")
+	}
+
+	// The caller's sampling decision is kept
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	unsampled := tracer.Start("proxy GET", KindServer, Extract(header))
+	unsampled.End()
+	if unsampled.Context().Sampled || len(tracer.exporter.queue) != 0 {
+		t.Fatalf("want an unsampled span which is not exported")
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+
+	span := tracer.Start("proxy GET", KindServer, SpanContext{})
+	span.SetAttribute("http.request.method", "GET")
+	span.SetError("failed")
+	span.Inject(http.Header{})
+	span.End()
+
+	if span.Context().IsValid() {
+		t.Fatalf("want no context from a nil tracer")
+	}
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	received := make(chan exportRequest, 1)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected export to %s as %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+
+		req := exportRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode: %s", err)
+		}
+		received <- req
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(collector.URL+"/", "inlets-server")
+
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span := tracer.Start("proxy GET", KindServer, parent)
+	span.SetAttribute("http.request.method", "GET")
+	span.SetAttribute("http.response.status_code", 502)
+	span.SetAttribute("inlets.upgraded", false)
+	span.SetError("no client connected")
+	span.End()
+	span.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracer.Flush(ctx); err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+
+	var req exportRequest
+	select {
+	case req = <-received:
+	default:
+		t.Fatalf("no spans were exported")
+	}
+
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("want one resource and scope, got %+v", req)
+	}
+	if service := req.ResourceSpans[0].Resource.Attributes; len(service) != 1 || *service[0].Value.StringValue != "inlets-server" {
+		t.Fatalf("want the service name, got %+v", service)
+	}
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("want the span exported once, got %d", len(spans))
+	}
+
+	got := spans[0]
+	if got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || got.ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatalf("want the parent's trace, got trace %s and parent %s", got.TraceID, got.ParentSpanID)
+	}
+	if got.Name != "proxy GET" || got.Kind != int(KindServer) {
+		t.Fatalf("want a server span named proxy GET, got %s of kind %d", got.Name, got.Kind)
+	}
+	if got.Status == nil || got.Status.Code != statusError || got.Status.Message != "no client connected" {
+		t.Fatalf("want an error status, got %+v", got.Status)
+	}
+
+	attributes := map[string]anyValue{}
+	for _, kv := range got.Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+	if v := attributes["http.request.method"].StringValue; v == nil || *v != "GET" {
+		t.Errorf("want the method as a string")
+	}
+	if v := attributes["http.response.status_code"].IntValue; v == nil || *v != "502" {
+		t.Errorf("want the status code as an int")
+	}
+	if v := attributes["inlets.upgraded"].BoolValue; v == nil || *v {
+		t.Errorf("want upgraded as a bool")
+	}
+}
+
+func TestExportToCollectorWhichFails(t *testing.T) {
+	requests := make(chan struct{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(collector.URL+"/v1/traces", "inlets-server")
+	tracer.Start("proxy GET", KindServer, SpanContext{}).End()
+
+	// The failure is logged and the tracer carries on
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracer.Flush(ctx); err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+
+	select {
+	case <-requests:
+	default:
+		t.Fatalf("no export was attempted")
+	}
+}
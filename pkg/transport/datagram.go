@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxDatagramSize is the largest UDP payload relayed through the tunnel
+const MaxDatagramSize = 65535
+
+// WriteDatagram writes p to a stream prefixed by its length so that the
+// peer can recover the datagram boundaries
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return fmt.Errorf("datagram too large: %d bytes", len(p))
+	}
+
+	_, err := w.Write(datagram(p))
+	return err
+}
+
+// TryWriteDatagram writes p as WriteDatagram does unless the peer has not
+// granted enough window for it, in which case it is dropped as UDP would
+// and false is returned
+func TryWriteDatagram(st *Stream, p []byte) (bool, error) {
+	if len(p) > MaxDatagramSize {
+		return false, fmt.Errorf("datagram too large: %d bytes", len(p))
+	}
+
+	return st.TryWrite(datagram(p))
+}
+
+func datagram(p []byte) []byte {
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+	return buf
+}
+
+// ReadDatagram reads a datagram written by WriteDatagram
+func ReadDatagram(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
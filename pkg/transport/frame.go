@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Frame types of the tunnel protocol. Each websocket binary message carries
+// a single frame made up of the type, the length of the stream ID, the
+// stream ID (the x-inlets-id of a request) and a payload.
+const (
+	// FrameOpen starts a stream, the payload names its target i.e. "http"
+	FrameOpen byte = iota + 1
+
+	// FrameData carries up to MaxFramePayload bytes of a stream
+	FrameData
+
+	// FrameWindow grants the peer a uint32 number of bytes more to send
+	FrameWindow
+
+	// FrameClose tells the peer the sender has finished writing
+	FrameClose
+
+	// FrameReset aborts the stream in both directions
+	FrameReset
+
+	// FrameGoAway tells the peer that no new streams should be opened as
+	// the sender is shutting down, it has no stream ID
+	FrameGoAway
+)
+
+// MaxFramePayload is the largest chunk of a stream sent in one frame
+const MaxFramePayload = 32 * 1024
+
+// InitialWindow is the number of bytes which may be sent on a stream before
+// the receiver has to grant more through a FrameWindow
+const InitialWindow = 256 * 1024
+
+type frame struct {
+	kind    byte
+	id      string
+	payload []byte
+}
+
+func (f *frame) marshal() []byte {
+	buf := make([]byte, 2+len(f.id)+len(f.payload))
+	buf[0] = f.kind
+	buf[1] = byte(len(f.id))
+	copy(buf[2:], f.id)
+	copy(buf[2+len(f.id):], f.payload)
+	return buf
+}
+
+func unmarshalFrame(msg []byte) (*frame, error) {
+	if len(msg) < 2 {
+		return nil, fmt.Errorf("frame too short: %d bytes", len(msg))
+	}
+
+	idLen := int(msg[1])
+	if len(msg) < 2+idLen {
+		return nil, fmt.Errorf("frame too short for stream ID: %d bytes", len(msg))
+	}
+
+	return &frame{
+		kind:    msg[0],
+		id:      string(msg[2 : 2+idLen]),
+		payload: msg[2+idLen:],
+	}, nil
+}
+
+func windowPayload(n int) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(n))
+	return buf
+}
@@ -0,0 +1,77 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame frame
+	}{
+		{"open", frame{kind: FrameOpen, id: "6a1e1ea9", payload: []byte(TargetHTTP)}},
+		{"data", frame{kind: FrameData, id: "6a1e1ea9", payload: bytes.Repeat([]byte{0xff}, MaxFramePayload)}},
+		{"window", frame{kind: FrameWindow, id: "6a1e1ea9", payload: windowPayload(InitialWindow)}},
+		{"close without payload", frame{kind: FrameClose, id: "6a1e1ea9"}},
+		{"reset", frame{kind: FrameReset, id: "6a1e1ea9"}},
+		{"go away without stream", frame{kind: FrameGoAway}},
+		{"longest stream ID", frame{kind: FrameData, id: strings.Repeat("a", 255), payload: []byte("x")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := test.frame.marshal()
+			if want := 2 + len(test.frame.id) + len(test.frame.payload); len(msg) != want {
+				t.Fatalf("want %d bytes, got %d", want, len(msg))
+			}
+
+			got, err := unmarshalFrame(msg)
+			if err != nil {
+				t.Fatalf("unmarshal: %s", err)
+			}
+			if got.kind != test.frame.kind {
+				t.Errorf("want kind %d, got %d", test.frame.kind, got.kind)
+			}
+			if got.id != test.frame.id {
+				t.Errorf("want id %q, got %q", test.frame.id, got.id)
+			}
+			if !bytes.Equal(got.payload, test.frame.payload) {
+				t.Errorf("want payload of %d bytes, got %d", len(test.frame.payload), len(got.payload))
+			}
+		})
+	}
+}
+
+func TestUnmarshalFrameErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"empty", []byte{}},
+		{"kind only", []byte{FrameData}},
+		{"truncated stream ID", []byte{FrameData, 4, 'a', 'b'}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := unmarshalFrame(test.msg); err == nil {
+				t.Fatalf("want an error for %v", test.msg)
+			}
+		})
+	}
+}
+
+func TestWindowPayload(t *testing.T) {
+	for _, n := range []int{0, 1, InitialWindow / 2, InitialWindow, 1<<32 - 1} {
+		payload := windowPayload(n)
+		if len(payload) != 4 {
+			t.Fatalf("want 4 bytes, got %d", len(payload))
+		}
+		if got := int(binary.BigEndian.Uint32(payload)); got != n {
+			t.Errorf("want %d, got %d", n, got)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+)
+
+// TargetHTTP is the target of streams which carry an HTTP request
+const TargetHTTP = "http"
+
+// WriteRequest writes req and streams its body to w
+func WriteRequest(w io.Writer, req *http.Request) error {
+	bw := bufio.NewWriterSize(w, MaxFramePayload)
+	if req.Body != nil {
+		req.Body = &flushingBody{ReadCloser: req.Body, w: bw}
+	}
+
+	if err := req.Write(bufferedWriter{bw}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// WriteResponse writes res and streams its body to w
+func WriteResponse(w io.Writer, res *http.Response) error {
+	bw := bufio.NewWriterSize(w, MaxFramePayload)
+	if res.Body != nil {
+		res.Body = &flushingBody{ReadCloser: res.Body, w: bw}
+	}
+
+	if err := res.Write(bufferedWriter{bw}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// flushingBody flushes what has been buffered so far each time more of
+// the body is read, so that a body which arrives slowly is passed through
+// as it arrives rather than once the buffer fills.
+type flushingBody struct {
+	io.ReadCloser
+	w *bufio.Writer
+}
+
+func (b *flushingBody) Read(p []byte) (int, error) {
+	if err := b.w.Flush(); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// bufferedWriter hides bufio.Writer's ReadFrom, which reads the body
+// straight into the buffer that flushingBody flushes
+type bufferedWriter struct {
+	bw *bufio.Writer
+}
+
+func (w bufferedWriter) Write(p []byte) (int, error) {
+	return w.bw.Write(p)
+}
+
+func (w bufferedWriter) WriteByte(c byte) error {
+	return w.bw.WriteByte(c)
+}
@@ -0,0 +1,352 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// ErrSessionClosed is returned by streams whose tunnel connection has gone
+var ErrSessionClosed = errors.New("tunnel connection closed")
+
+// maxAcceptBacklog limits the streams opened by the peer which are
+// waiting to be accepted
+const maxAcceptBacklog = 1024
+
+// Session multiplexes streams of request and response bodies over a single
+// websocket connection
+type Session struct {
+	// bytesReceived and bytesSent come first so that they are 64-bit
+	// aligned for atomic access on 32-bit platforms
+	bytesReceived int64
+	bytesSent     int64
+
+	ws        *websocket.Conn
+	writeLock sync.Mutex
+
+	// readTimeout and writeTimeout are set by Heartbeat
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	lock       sync.Mutex
+	streams    map[string]*Stream
+	accepted   []*Stream
+	acceptCond *sync.Cond
+	err        error
+	done       chan struct{}
+	goingAway  chan struct{}
+}
+
+// NewSession creates a session over ws, call Serve to start reading frames
+func NewSession(ws *websocket.Conn) *Session {
+	s := &Session{
+		ws:        ws,
+		streams:   make(map[string]*Stream),
+		done:      make(chan struct{}),
+		goingAway: make(chan struct{}),
+	}
+	s.acceptCond = sync.NewCond(&s.lock)
+	return s
+}
+
+// Heartbeat pings the peer every interval and closes the session when
+// nothing, not even a pong, is read from it for interval plus timeout, or a
+// frame can't be written within timeout. This finds half-open connections
+// which would otherwise look up forever. Call it before Serve.
+func (s *Session) Heartbeat(interval, timeout time.Duration) {
+	if interval <= 0 || timeout <= 0 {
+		return
+	}
+
+	s.readTimeout = interval + timeout
+	s.writeTimeout = timeout
+	s.extendReadDeadline()
+
+	s.ws.SetPongHandler(func(string) error {
+		s.extendReadDeadline()
+		return nil
+	})
+
+	// A ping from a peer with its own heartbeat shows it is alive too
+	s.ws.SetPingHandler(func(data string) error {
+		s.extendReadDeadline()
+
+		err := s.ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(timeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	go s.ping(interval, timeout)
+}
+
+func (s *Session) ping(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+				// Closing the websocket fails the read in Serve
+				s.ws.Close()
+				return
+			}
+		}
+	}
+}
+
+func (s *Session) extendReadDeadline() {
+	s.ws.SetReadDeadline(time.Now().Add(s.readTimeout))
+}
+
+// Serve reads frames and dispatches them to their streams until the
+// websocket fails or the session is closed
+func (s *Session) Serve() error {
+	for {
+		msgType, message, err := s.ws.ReadMessage()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && s.readTimeout > 0 {
+				err = fmt.Errorf("no heartbeat from the peer for %s", s.readTimeout)
+			}
+			s.shutdown(err)
+
+			// A session closed on this side reports ErrSessionClosed
+			// rather than the failed read
+			s.lock.Lock()
+			err = s.err
+			s.lock.Unlock()
+			return err
+		}
+
+		if s.readTimeout > 0 {
+			s.extendReadDeadline()
+		}
+
+		atomic.AddInt64(&s.bytesReceived, int64(len(message)))
+
+		if msgType != websocket.BinaryMessage {
+			logger.Debugf("TextMessage: %s", message)
+			continue
+		}
+
+		f, err := unmarshalFrame(message)
+		if err != nil {
+			logger.Errorf("unable to read frame: %s", err)
+			continue
+		}
+
+		s.handle(f)
+	}
+}
+
+func (s *Session) handle(f *frame) {
+	if f.kind == FrameOpen {
+		s.acceptStream(f.id, string(f.payload))
+		return
+	}
+
+	if f.kind == FrameGoAway {
+		s.lock.Lock()
+		select {
+		case <-s.goingAway:
+		default:
+			close(s.goingAway)
+		}
+		s.lock.Unlock()
+		return
+	}
+
+	s.lock.Lock()
+	st := s.streams[f.id]
+	s.lock.Unlock()
+
+	if st == nil {
+		// Streams are forgotten once reset or timed-out, so anything
+		// arriving late for them is discarded.
+		if f.kind == FrameData || f.kind == FrameClose {
+			logger.ID(f.id).Warnf("dropping frame for unknown stream, the request may have timed out")
+		}
+		return
+	}
+
+	switch f.kind {
+	case FrameData:
+		st.receive(f.payload)
+	case FrameWindow:
+		if len(f.payload) == 4 {
+			st.grant(int(binary.BigEndian.Uint32(f.payload)))
+		}
+	case FrameClose:
+		st.remoteClose()
+	case FrameReset:
+		s.remove(st.id)
+		st.fail(ErrStreamReset)
+	default:
+		logger.ID(f.id).Errorf("unknown frame type: %d", f.kind)
+	}
+}
+
+func (s *Session) acceptStream(id, target string) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return
+	}
+
+	if _, exists := s.streams[id]; exists || len(s.accepted) >= maxAcceptBacklog {
+		s.lock.Unlock()
+		logger.ID(id).Warnf("refusing stream")
+		s.writeFrame(FrameReset, id, nil)
+		return
+	}
+
+	st := newStream(s, id, target)
+	s.streams[id] = st
+	s.accepted = append(s.accepted, st)
+	s.acceptCond.Signal()
+	s.lock.Unlock()
+}
+
+// Open starts a new stream to the peer identified by id
+func (s *Session) Open(id, target string) (*Stream, error) {
+	if len(id) > 255 {
+		return nil, fmt.Errorf("stream ID too long: %s", id)
+	}
+
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if _, exists := s.streams[id]; exists {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("stream already open: %s", id)
+	}
+
+	st := newStream(s, id, target)
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	if err := s.writeFrame(FrameOpen, id, []byte(target)); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream
+func (s *Session) Accept() (*Stream, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.accepted) == 0 && s.err == nil {
+		s.acceptCond.Wait()
+	}
+
+	if len(s.accepted) == 0 {
+		return nil, ErrSessionClosed
+	}
+
+	st := s.accepted[0]
+	s.accepted = s.accepted[1:]
+	return st, nil
+}
+
+// Done is closed once the underlying websocket has failed or been closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// GoAway tells the peer to stop opening streams, those already open carry
+// on until they finish or the session is closed
+func (s *Session) GoAway() error {
+	return s.writeFrame(FrameGoAway, "", nil)
+}
+
+// GoingAway is closed once the peer has sent GoAway
+func (s *Session) GoingAway() <-chan struct{} {
+	return s.goingAway
+}
+
+// Close fails every open stream, tells the peer the connection is going
+// away and closes the websocket
+func (s *Session) Close() error {
+	s.shutdown(ErrSessionClosed)
+
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+	s.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+
+	return s.ws.Close()
+}
+
+func (s *Session) shutdown(err error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return
+	}
+
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[string]*Stream)
+	s.accepted = nil
+	s.acceptCond.Broadcast()
+	close(s.done)
+	s.lock.Unlock()
+
+	for _, st := range streams {
+		st.fail(ErrSessionClosed)
+	}
+}
+
+func (s *Session) remove(id string) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	s.lock.Unlock()
+}
+
+func (s *Session) writeFrame(kind byte, id string, payload []byte) error {
+	f := frame{kind: kind, id: id, payload: payload}
+
+	message := f.marshal()
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.writeTimeout > 0 {
+		s.ws.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+
+	atomic.AddInt64(&s.bytesSent, int64(len(message)))
+	if err := s.ws.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		// The websocket can't be written to after an error, closing it
+		// fails the read in Serve and with it every stream
+		s.ws.Close()
+		return err
+	}
+	return nil
+}
+
+// BytesReceived returns how many bytes of frames have been read from the
+// websocket
+func (s *Session) BytesReceived() int64 {
+	return atomic.LoadInt64(&s.bytesReceived)
+}
+
+// BytesSent returns how many bytes of frames have been written to the
+// websocket
+func (s *Session) BytesSent() int64 {
+	return atomic.LoadInt64(&s.bytesSent)
+}
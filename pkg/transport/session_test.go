@@ -0,0 +1,535 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newSessionPair connects two sessions over a websocket and serves both,
+// the first is the side which dialled
+func newSessionPair(t *testing.T) (*Session, *Session) {
+	t.Helper()
+
+	accepted := make(chan *Session, 1)
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %s", err)
+			return
+		}
+		accepted <- NewSession(ws)
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+
+	dialled := NewSession(ws)
+	served := <-accepted
+
+	for _, s := range []*Session{dialled, served} {
+		s := s
+		go s.Serve()
+		t.Cleanup(func() { s.Close() })
+	}
+
+	return dialled, served
+}
+
+// openPair opens a stream from one session and accepts it on the other
+func openPair(t *testing.T, from, to *Session, id string) (*Stream, *Stream) {
+	t.Helper()
+
+	opened, err := from.Open(id, TargetHTTP)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	accepted, err := to.Accept()
+	if err != nil {
+		t.Fatalf("accept: %s", err)
+	}
+	if accepted.ID() != id || accepted.Target() != TargetHTTP {
+		t.Fatalf("want stream %s for %s, got %s for %s", id, TargetHTTP, accepted.ID(), accepted.Target())
+	}
+
+	return opened, accepted
+}
+
+// within fails the test when fn has not returned after d
+func within(t *testing.T, d time.Duration, what string, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatalf("%s did not return within %s", what, d)
+	}
+}
+
+// blocked reports whether done stays open for d
+func blocked(done <-chan struct{}, d time.Duration) bool {
+	select {
+	case <-done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func TestStreamCarriesDataBothWays(t *testing.T) {
+	dialled, served := newSessionPair(t)
+	opened, accepted := openPair(t, served, dialled, "request-1")
+
+	request := bytes.Repeat([]byte("request "), 3*MaxFramePayload/8+1)
+	go func() {
+		opened.Write(request)
+		opened.Close()
+	}()
+
+	var got []byte
+	within(t, 5*time.Second, "reading the request", func() {
+		var err error
+		got, err = ioutil.ReadAll(accepted)
+		if err != nil {
+			t.Errorf("read: %s", err)
+		}
+	})
+	if !bytes.Equal(got, request) {
+		t.Fatalf("want %d bytes, got %d", len(request), len(got))
+	}
+
+	// The acceptor can still write after the opener has closed its side
+	if _, err := accepted.Write([]byte("response")); err != nil {
+		t.Fatalf("write after the peer closed: %s", err)
+	}
+	accepted.Close()
+
+	within(t, 5*time.Second, "reading the response", func() {
+		got, _ = ioutil.ReadAll(opened)
+	})
+	if string(got) != "response" {
+		t.Fatalf("want response, got %q", got)
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	tests := []struct {
+		name   string
+		opener bool
+	}{
+		{"closed by the opener", true},
+		{"closed by the acceptor", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialled, served := newSessionPair(t)
+			opened, accepted := openPair(t, dialled, served, "close")
+
+			closer, peer := accepted, opened
+			if test.opener {
+				closer, peer = opened, accepted
+			}
+
+			if err := closer.Close(); err != nil {
+				t.Fatalf("close: %s", err)
+			}
+			if _, err := closer.Write([]byte("late")); err != ErrStreamClosed {
+				t.Fatalf("want %s writing after close, got %v", ErrStreamClosed, err)
+			}
+
+			within(t, 5*time.Second, "reading from the peer", func() {
+				if n, err := peer.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+					t.Errorf("want EOF, got %d bytes and %v", n, err)
+				}
+			})
+
+			// Half-closed, the peer can still answer
+			go func() {
+				peer.Write([]byte("answer"))
+				peer.Close()
+			}()
+			within(t, 5*time.Second, "reading the answer", func() {
+				got, err := ioutil.ReadAll(closer)
+				if err != nil || string(got) != "answer" {
+					t.Errorf("want answer, got %q and %v", got, err)
+				}
+			})
+
+			// Once both sides have closed the stream is forgotten
+			within(t, 5*time.Second, "removing the stream", func() {
+				for dialled.streamCount() > 0 || served.streamCount() > 0 {
+					time.Sleep(10 * time.Millisecond)
+				}
+			})
+
+			select {
+			case <-closer.Done():
+				t.Fatalf("Done is closed for a stream which finished normally")
+			default:
+			}
+		})
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	tests := []struct {
+		name   string
+		opener bool
+	}{
+		{"reset by the opener", true},
+		{"reset by the acceptor", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialled, served := newSessionPair(t)
+			opened, accepted := openPair(t, dialled, served, "reset")
+
+			resetter, peer := accepted, opened
+			if test.opener {
+				resetter, peer = opened, accepted
+			}
+
+			// The peer is waiting to read when the reset arrives
+			read := make(chan error, 1)
+			go func() {
+				_, err := peer.Read(make([]byte, 8))
+				read <- err
+			}()
+
+			if err := resetter.Reset(); err != nil {
+				t.Fatalf("reset: %s", err)
+			}
+
+			select {
+			case err := <-read:
+				if err != ErrStreamReset {
+					t.Fatalf("want %s, got %v", ErrStreamReset, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("read was not unblocked by the reset")
+			}
+
+			for _, st := range []*Stream{resetter, peer} {
+				select {
+				case <-st.Done():
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Done is not closed for a reset stream")
+				}
+
+				if _, err := st.Write([]byte("x")); err != ErrStreamReset {
+					t.Fatalf("want %s writing to a reset stream, got %v", ErrStreamReset, err)
+				}
+			}
+
+			if dialled.streamCount() != 0 || served.streamCount() != 0 {
+				t.Fatalf("reset streams are still tracked")
+			}
+
+			// Resetting again does nothing
+			if err := resetter.Reset(); err != nil {
+				t.Fatalf("second reset: %s", err)
+			}
+		})
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	dialled, served := newSessionPair(t)
+	opened, accepted := openPair(t, dialled, served, "window")
+
+	// The writer can send a full window without the reader doing anything,
+	// but then waits for it to read
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		if _, err := opened.Write(make([]byte, InitialWindow+1)); err != nil {
+			t.Errorf("write: %s", err)
+		}
+	}()
+
+	within(t, 5*time.Second, "filling the window", func() {
+		for accepted.buffered() < InitialWindow {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	if !blocked(written, 200*time.Millisecond) {
+		t.Fatalf("write finished without the reader granting more window")
+	}
+	if n := opened.window(); n != 0 {
+		t.Fatalf("want the send window exhausted, got %d", n)
+	}
+
+	// Reading less than half the window grants nothing yet
+	read(t, accepted, InitialWindow/2-1)
+	if !blocked(written, 200*time.Millisecond) {
+		t.Fatalf("window was granted before half of it had been read")
+	}
+
+	// Reaching half grants what has been read
+	read(t, accepted, 1)
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("write was not unblocked by the granted window")
+	}
+
+	// Everything is delivered once the rest is read
+	read(t, accepted, InitialWindow/2+1)
+	if n := accepted.buffered(); n != 0 {
+		t.Fatalf("want nothing buffered, got %d bytes", n)
+	}
+}
+
+func TestStreamTryWrite(t *testing.T) {
+	dialled, served := newSessionPair(t)
+	opened, accepted := openPair(t, dialled, served, "try-write")
+
+	// Larger than a frame, so it is sent in pieces
+	first := bytes.Repeat([]byte("a"), MaxFramePayload+1)
+	if sent, err := opened.TryWrite(first); !sent || err != nil {
+		t.Fatalf("want the write sent, got %t and %v", sent, err)
+	}
+
+	// Nothing is sent, nor does it wait, when the rest of the window is
+	// too small for all of p
+	rest := InitialWindow - len(first)
+	within(t, time.Second, "trying to write", func() {
+		if sent, err := opened.TryWrite(make([]byte, rest+1)); sent || err != nil {
+			t.Errorf("want the write dropped, got %t and %v", sent, err)
+		}
+	})
+	if n := opened.window(); n != rest {
+		t.Fatalf("want %d bytes of window left, got %d", rest, n)
+	}
+
+	read(t, accepted, len(first))
+	if n := accepted.buffered(); n != 0 {
+		t.Fatalf("want nothing more delivered, got %d bytes", n)
+	}
+
+	opened.Reset()
+	if _, err := opened.TryWrite([]byte("x")); err != ErrStreamReset {
+		t.Fatalf("want %s writing to a reset stream, got %v", ErrStreamReset, err)
+	}
+}
+
+// read reads exactly n bytes from st
+func read(t *testing.T, st *Stream, n int) {
+	t.Helper()
+
+	within(t, 5*time.Second, "reading", func() {
+		if _, err := io.ReadFull(st, make([]byte, n)); err != nil {
+			t.Errorf("read %d bytes: %s", n, err)
+		}
+	})
+}
+
+func TestStreamResetWhenPeerOverrunsWindow(t *testing.T) {
+	dialled, served := newSessionPair(t)
+	opened, accepted := openPair(t, dialled, served, "overrun")
+
+	// A peer which ignores flow control gets the stream reset
+	accepted.receive(make([]byte, InitialWindow))
+	accepted.receive([]byte("x"))
+
+	select {
+	case <-accepted.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("overrun stream was not reset")
+	}
+
+	select {
+	case <-opened.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the peer was not told about the reset")
+	}
+}
+
+func TestSessionCloseUnblocksStreams(t *testing.T) {
+	tests := []struct {
+		name  string
+		local bool
+	}{
+		{"closed locally", true},
+		{"closed by the peer", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialled, served := newSessionPair(t)
+
+			reader, _ := openPair(t, dialled, served, "reader")
+			writer, _ := openPair(t, dialled, served, "writer")
+
+			// Exhaust the writer's window so that its next write waits
+			if _, err := writer.Write(make([]byte, InitialWindow)); err != nil {
+				t.Fatalf("write: %s", err)
+			}
+
+			errs := make(chan error, 3)
+			go func() {
+				_, err := reader.Read(make([]byte, 8))
+				errs <- err
+			}()
+			go func() {
+				_, err := writer.Write([]byte("more"))
+				errs <- err
+			}()
+			go func() {
+				_, err := dialled.Accept()
+				errs <- err
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+			if test.local {
+				dialled.Close()
+			} else {
+				served.Close()
+			}
+
+			for i := 0; i < 3; i++ {
+				select {
+				case err := <-errs:
+					if err == nil {
+						t.Fatalf("want an error once the session closed")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("a reader, writer or Accept was not unblocked")
+				}
+			}
+
+			select {
+			case <-dialled.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Done is not closed")
+			}
+
+			if _, err := dialled.Open("after", TargetHTTP); err != ErrSessionClosed {
+				t.Fatalf("want %s opening on a closed session, got %v", ErrSessionClosed, err)
+			}
+		})
+	}
+}
+
+func TestSessionGoAway(t *testing.T) {
+	dialled, served := newSessionPair(t)
+	opened, accepted := openPair(t, served, dialled, "in-flight")
+
+	if err := dialled.GoAway(); err != nil {
+		t.Fatalf("go away: %s", err)
+	}
+
+	select {
+	case <-served.GoingAway():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("GoingAway is not closed")
+	}
+
+	// Streams which are already open carry on
+	go func() {
+		accepted.Write([]byte("still here"))
+		accepted.Close()
+	}()
+	within(t, 5*time.Second, "reading", func() {
+		got, err := ioutil.ReadAll(opened)
+		if err != nil || string(got) != "still here" {
+			t.Errorf("want still here, got %q and %v", got, err)
+		}
+	})
+
+	select {
+	case <-dialled.GoingAway():
+		t.Fatalf("the side which sent GoAway is marked as going away")
+	default:
+	}
+}
+
+func TestSessionHeartbeat(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer bool
+		closed bool
+	}{
+		{"peer answers pings", true, false},
+		{"peer has gone quiet", false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upgrader := websocket.Upgrader{}
+			release := make(chan struct{})
+			defer close(release)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					t.Errorf("upgrade: %s", err)
+					return
+				}
+				defer ws.Close()
+
+				// A peer which never reads never answers a ping either, as
+				// with a half-open connection
+				if test.answer {
+					go NewSession(ws).Serve()
+				}
+				<-release
+			}))
+			defer server.Close()
+
+			ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatalf("dial: %s", err)
+			}
+
+			s := NewSession(ws)
+			defer s.Close()
+			s.Heartbeat(50*time.Millisecond, 50*time.Millisecond)
+			go s.Serve()
+
+			if closed := !blocked(s.Done(), 500*time.Millisecond); closed != test.closed {
+				t.Fatalf("want closed %t, got %t", test.closed, closed)
+			}
+		})
+	}
+}
+
+func (s *Session) streamCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+func (st *Stream) buffered() int {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.readBuf.Len()
+}
+
+func (st *Stream) window() int {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.sendWindow
+}
@@ -0,0 +1,264 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrStreamReset is returned by a stream which has been aborted
+var ErrStreamReset = errors.New("stream reset")
+
+// ErrStreamClosed is returned when writing to a stream after Close
+var ErrStreamClosed = errors.New("stream closed for writing")
+
+// Stream is one request and its response multiplexed over a Session. The
+// sender may only have InitialWindow bytes in flight and waits for the
+// receiver to grant more as it reads, so a slow reader holds back only its
+// own stream.
+type Stream struct {
+	id      string
+	target  string
+	session *Session
+
+	lock         sync.Mutex
+	cond         *sync.Cond
+	readBuf      bytes.Buffer
+	unacked      int
+	sendWindow   int
+	remoteClosed bool
+	localClosed  bool
+	err          error
+
+	// done is closed when err is set
+	done chan struct{}
+}
+
+func newStream(session *Session, id, target string) *Stream {
+	st := &Stream{
+		id:         id,
+		target:     target,
+		session:    session,
+		sendWindow: InitialWindow,
+		done:       make(chan struct{}),
+	}
+	st.cond = sync.NewCond(&st.lock)
+	return st
+}
+
+// ID of the stream, which is the x-inlets-id of the request it carries
+func (st *Stream) ID() string {
+	return st.id
+}
+
+// Target names what the stream carries, as given to Session.Open
+func (st *Stream) Target() string {
+	return st.target
+}
+
+// Done is closed once the stream has been reset by either side or its
+// session has closed, but not when it finishes normally
+func (st *Stream) Done() <-chan struct{} {
+	return st.done
+}
+
+// Read reads data sent by the peer, returning io.EOF once it has closed
+// its side of the stream
+func (st *Stream) Read(p []byte) (int, error) {
+	st.lock.Lock()
+	for st.readBuf.Len() == 0 && !st.remoteClosed && st.err == nil {
+		st.cond.Wait()
+	}
+
+	// Data which arrived before the peer reset the stream or the tunnel
+	// dropped is still delivered, followed by the error.
+	if st.readBuf.Len() == 0 {
+		err := st.err
+		if err == nil {
+			err = io.EOF
+		}
+		st.lock.Unlock()
+		return 0, err
+	}
+
+	n, _ := st.readBuf.Read(p)
+
+	// Grant the peer more window once half of it has been consumed
+	grant := 0
+	st.unacked += n
+	if st.unacked >= InitialWindow/2 {
+		grant = st.unacked
+		st.unacked = 0
+	}
+	st.lock.Unlock()
+
+	if grant > 0 {
+		st.session.writeFrame(FrameWindow, st.id, windowPayload(grant))
+	}
+
+	return n, nil
+}
+
+// Write sends p to the peer in chunks, waiting whenever the peer has not
+// granted enough window
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		st.lock.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.localClosed {
+			st.cond.Wait()
+		}
+
+		if st.err != nil {
+			st.lock.Unlock()
+			return written, st.err
+		}
+
+		if st.localClosed {
+			st.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		n := len(p)
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > MaxFramePayload {
+			n = MaxFramePayload
+		}
+		st.sendWindow -= n
+		st.lock.Unlock()
+
+		if err := st.session.writeFrame(FrameData, st.id, p[:n]); err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// TryWrite sends all of p when the peer has granted enough window for it,
+// otherwise it sends nothing and returns false straight away
+func (st *Stream) TryWrite(p []byte) (bool, error) {
+	st.lock.Lock()
+	if st.err != nil {
+		st.lock.Unlock()
+		return false, st.err
+	}
+	if st.localClosed {
+		st.lock.Unlock()
+		return false, ErrStreamClosed
+	}
+	if len(p) > st.sendWindow {
+		st.lock.Unlock()
+		return false, nil
+	}
+	st.sendWindow -= len(p)
+	st.lock.Unlock()
+
+	for len(p) > 0 {
+		n := len(p)
+		if n > MaxFramePayload {
+			n = MaxFramePayload
+		}
+
+		if err := st.session.writeFrame(FrameData, st.id, p[:n]); err != nil {
+			return false, err
+		}
+		p = p[n:]
+	}
+
+	return true, nil
+}
+
+// Close tells the peer that nothing more will be written, the stream can
+// still be read until the peer closes its side
+func (st *Stream) Close() error {
+	st.lock.Lock()
+	if st.localClosed || st.err != nil {
+		st.lock.Unlock()
+		return nil
+	}
+
+	st.localClosed = true
+	finished := st.remoteClosed
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	if finished {
+		st.session.remove(st.id)
+	}
+
+	return st.session.writeFrame(FrameClose, st.id, nil)
+}
+
+// Reset aborts the stream in both directions unless it has already
+// finished, anything the peer sends afterwards is dropped
+func (st *Stream) Reset() error {
+	st.lock.Lock()
+	if st.err != nil || (st.localClosed && st.remoteClosed) {
+		st.lock.Unlock()
+		return nil
+	}
+
+	st.err = ErrStreamReset
+	close(st.done)
+	st.readBuf.Reset()
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	st.session.remove(st.id)
+	return st.session.writeFrame(FrameReset, st.id, nil)
+}
+
+func (st *Stream) receive(data []byte) {
+	st.lock.Lock()
+	if st.err != nil || st.remoteClosed {
+		st.lock.Unlock()
+		return
+	}
+
+	if st.readBuf.Len()+st.unacked+len(data) > InitialWindow {
+		st.lock.Unlock()
+		st.Reset()
+		return
+	}
+
+	st.readBuf.Write(data)
+	st.cond.Broadcast()
+	st.lock.Unlock()
+}
+
+func (st *Stream) grant(n int) {
+	st.lock.Lock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+	st.lock.Unlock()
+}
+
+func (st *Stream) remoteClose() {
+	st.lock.Lock()
+	st.remoteClosed = true
+	finished := st.localClosed
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	if finished {
+		st.session.remove(st.id)
+	}
+}
+
+func (st *Stream) fail(err error) {
+	st.lock.Lock()
+	if st.err == nil {
+		st.err = err
+		close(st.done)
+	}
+	st.cond.Broadcast()
+	st.lock.Unlock()
+}
@@ -5,6 +5,26 @@ import "net/http"
 // InletsHeader is used for internal connection-tracking
 const InletsHeader = "x-inlets-id"
 
+// UserHeader carries the email address of a user who logged in through
+// OpenID Connect to the upstream
+const UserHeader = "x-inlets-user"
+
+// UpstreamHeader is sent by a client when connecting to advertise the
+// comma-separated hostnames it serves
+const UpstreamHeader = "x-inlets-upstream"
+
+// DefaultUpstream is advertised by a client which serves any hostname not
+// claimed by another client
+const DefaultUpstream = "*"
+
+// TCPPrefix marks an upstream which forwards a TCP port on the server
+// rather than a hostname, i.e. tcp:2222=127.0.0.1:22
+const TCPPrefix = "tcp:"
+
+// UDPPrefix marks an upstream which relays datagrams sent to a UDP port on
+// the server, i.e. udp:5353=127.0.0.1:53
+const UDPPrefix = "udp:"
+
 // CopyHeaders copies headers from one http.Header to another by value
 func CopyHeaders(destination http.Header, source *http.Header) {
 	for k, v := range *source {
@@ -0,0 +1,56 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// IsUpgrade reports whether a request asks to switch protocols, such as to
+// a WebSocket
+func IsUpgrade(header http.Header) bool {
+	if len(header.Get("Upgrade")) == 0 {
+		return false
+	}
+
+	for _, value := range header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadWriteCloser joins a reader, such as a bufio.Reader which may hold
+// data already read from a connection, with the connection's writer and
+// closer
+type ReadWriteCloser struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// Pipe copies between a and b in both directions, once either direction
+// finishes both are closed
+func Pipe(a, b io.ReadWriteCloser) {
+	closeBoth := sync.Once{}
+	done := make(chan struct{}, 2)
+
+	copyAndClose := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		closeBoth.Do(func() {
+			a.Close()
+			b.Close()
+		})
+		done <- struct{}{}
+	}
+
+	go copyAndClose(a, b)
+	go copyAndClose(b, a)
+
+	<-done
+	<-done
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alexellis/inlets/pkg/token"
+)
+
+// tokenCommand runs the "token" subcommand, "inlets token issue" prints a
+// signed token for the server's --token-secret
+func tokenCommand(args []string) error {
+	if len(args) == 0 || args[0] != "issue" {
+		return fmt.Errorf("usage: inlets token issue --token-secret <secret> --name <name> --hosts <hosts> [--ttl 1h]")
+	}
+
+	flags := flag.NewFlagSet("token issue", flag.ContinueOnError)
+
+	secret := flags.String("token-secret", "", "secret given to the server with --token-secret")
+	name := flags.String("name", "", "name of the client the token is for")
+	hosts := flags.String("hosts", "", "comma-separated hostnames the client may serve i.e. preview.example.com,tcp:2222")
+	ttl := flags.Duration("ttl", time.Hour, "how long the token is valid for")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if len(*secret) == 0 {
+		return fmt.Errorf("give --token-secret")
+	}
+	if len(*name) == 0 {
+		return fmt.Errorf("give --name")
+	}
+	if len(*hosts) == 0 {
+		return fmt.Errorf("give --hosts")
+	}
+	if *ttl <= 0 {
+		return fmt.Errorf("give a positive --ttl")
+	}
+
+	claims := token.Claims{
+		Subject:   *name,
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: time.Now().Add(*ttl).Unix(),
+	}
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); len(host) > 0 {
+			claims.Hosts = append(claims.Hosts, host)
+		}
+	}
+
+	signed, err := token.Issue([]byte(*secret), claims)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(signed)
+	return nil
+}